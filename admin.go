@@ -0,0 +1,116 @@
+package caddyconsulingress
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// The client of the running app, reported on by the admin API
+var activeClient atomic.Pointer[ConsulIngressClient]
+
+// Admin API endpoints to inspect the routing state of the ingress
+type AdminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.consul_ingress",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Routes returns the admin routes
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/consul-ingress/routes",
+			Handler: caddy.AdminHandlerFunc(a.handleRoutes),
+		},
+		{
+			Pattern: "/consul-ingress/status",
+			Handler: caddy.AdminHandlerFunc(a.handleStatus),
+		},
+		{
+			Pattern: "/consul-ingress/resync",
+			Handler: caddy.AdminHandlerFunc(a.handleResync),
+		},
+	}
+}
+
+// Returns the services parsed from the catalog and KV store
+func (a *AdminAPI) handleRoutes(w http.ResponseWriter, r *http.Request) error {
+	client, err := runningClient(r, http.MethodGet)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, client.Routes())
+}
+
+// Returns the generated config, the last error and the state of the watchers
+func (a *AdminAPI) handleStatus(w http.ResponseWriter, r *http.Request) error {
+	client, err := runningClient(r, http.MethodGet)
+	if err != nil {
+		return err
+	}
+
+	return writeJSON(w, client.Status())
+}
+
+// Re-reads the services from Consul and reloads the config, returns the status after the reload
+func (a *AdminAPI) handleResync(w http.ResponseWriter, r *http.Request) error {
+	client, err := runningClient(r, http.MethodPost)
+	if err != nil {
+		return err
+	}
+
+	if err := client.Resync(); err != nil {
+		status := http.StatusInternalServerError
+		var consulErr *consulError
+		if errors.As(err, &consulErr) {
+			status = http.StatusBadGateway
+		}
+
+		return caddy.APIError{
+			HTTPStatus: status,
+			Err:        fmt.Errorf("resync failed: %w", err),
+		}
+	}
+
+	return writeJSON(w, client.Status())
+}
+
+// Returns the client of the running app if the request uses the method
+func runningClient(r *http.Request, method string) (*ConsulIngressClient, error) {
+	if r.Method != method {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	client := activeClient.Load()
+	if client == nil {
+		return nil, caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("consul ingress is not running"),
+		}
+	}
+
+	return client, nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
@@ -0,0 +1,262 @@
+package caddyconsulingress
+
+import (
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func init() {
+	httpcaddyfile.RegisterGlobalOption("consul_ingress", parseGlobalOption)
+}
+
+func parseGlobalOption(d *caddyfile.Dispenser, _ any) (any, error) {
+	app := new(CaddyConsulIngress)
+	if err := app.UnmarshalCaddyfile(d); err != nil {
+		return nil, err
+	}
+
+	return httpcaddyfile.App{
+		Name:  "consul_ingress",
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+// UnmarshalCaddyfile sets up the app from Caddyfile tokens. Syntax:
+//
+//	consul_ingress {
+//	    template               <file>
+//	    consul_address         <address>
+//	    consul_token           <token>
+//	    consul_ca_file         <file>
+//	    consul_ca_path         <directory>
+//	    consul_cert_file       <file>
+//	    consul_key_file        <file>
+//	    consul_tls_server_name <name>
+//	    consul_tls_skip_verify
+//	    datacenters            <datacenters...>
+//	    failover_datacenters   <datacenters...>
+//	    namespaces             <namespaces...>
+//	    partitions             <partitions...>
+//	    url_prefix             <prefix>
+//	    meta_prefix            <prefix>
+//	    kv_path                <path>
+//	    storage_prefix         <prefix>
+//	    leader_key             <key>
+//	    wildcard_domains       <domains...>
+//	    polling_interval       <duration>
+//	    debounce               <duration>
+//	    debounce_max_delay     <duration>
+//	    upstreams              srv|health|consul
+//	    config_format          caddyfile|json
+//	    conflict_policy        first|kv|priority|merge
+//	    passing_only           <true|false>
+//	    verbose
+//	    restart_on_cfg_change
+//	}
+func (app *CaddyConsulIngress) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume option name
+
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "template":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.TemplateFile = d.Val()
+
+		case "consul_address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.ConsulAddress = d.Val()
+
+		case "consul_token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.ConsulToken = d.Val()
+
+		case "consul_ca_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.ConsulCAFile = d.Val()
+
+		case "consul_ca_path":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.ConsulCAPath = d.Val()
+
+		case "consul_cert_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.ConsulCertFile = d.Val()
+
+		case "consul_key_file":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.ConsulKeyFile = d.Val()
+
+		case "consul_tls_server_name":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.ConsulTLSServerName = d.Val()
+
+		case "consul_tls_skip_verify":
+			if d.NextArg() {
+				return d.ArgErr()
+			}
+			app.ConsulTLSSkipVerify = true
+
+		case "datacenters":
+			app.Datacenters = append(app.Datacenters, d.RemainingArgs()...)
+			if len(app.Datacenters) == 0 {
+				return d.ArgErr()
+			}
+
+		case "failover_datacenters":
+			app.FailoverDatacenters = append(app.FailoverDatacenters, d.RemainingArgs()...)
+			if len(app.FailoverDatacenters) == 0 {
+				return d.ArgErr()
+			}
+
+		case "namespaces":
+			app.Namespaces = append(app.Namespaces, d.RemainingArgs()...)
+			if len(app.Namespaces) == 0 {
+				return d.ArgErr()
+			}
+
+		case "partitions":
+			app.Partitions = append(app.Partitions, d.RemainingArgs()...)
+			if len(app.Partitions) == 0 {
+				return d.ArgErr()
+			}
+
+		case "url_prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.UrlPrefix = d.Val()
+
+		case "meta_prefix":
+			metaPrefix := ""
+			if d.NextArg() {
+				metaPrefix = d.Val()
+			}
+			app.MetaPrefix = &metaPrefix
+
+		case "kv_path":
+			kvPath := ""
+			if d.NextArg() {
+				kvPath = d.Val()
+			}
+			app.KVPath = &kvPath
+
+		case "storage_prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.StoragePrefix = d.Val()
+
+		case "leader_key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.LeaderKey = d.Val()
+
+		case "wildcard_domains":
+			app.WildcardDomains = append(app.WildcardDomains, d.RemainingArgs()...)
+			if len(app.WildcardDomains) == 0 {
+				return d.ArgErr()
+			}
+
+		case "polling_interval":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			interval, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid polling_interval '%s': %v", d.Val(), err)
+			}
+			app.PollingInterval = caddy.Duration(interval)
+
+		case "debounce":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			window, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid debounce '%s': %v", d.Val(), err)
+			}
+			debounceWindow := caddy.Duration(window)
+			app.DebounceWindow = &debounceWindow
+
+		case "debounce_max_delay":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			maxDelay, err := caddy.ParseDuration(d.Val())
+			if err != nil {
+				return d.Errf("invalid debounce_max_delay '%s': %v", d.Val(), err)
+			}
+			debounceMaxDelay := caddy.Duration(maxDelay)
+			app.DebounceMaxDelay = &debounceMaxDelay
+
+		case "upstreams":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.UpstreamMode = d.Val()
+
+		case "config_format":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.ConfigFormat = d.Val()
+
+		case "conflict_policy":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			app.ConflictPolicy = d.Val()
+
+		case "passing_only":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			passingOnly, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return d.Errf("invalid passing_only value '%s': %v", d.Val(), err)
+			}
+			app.HealthPassingOnly = &passingOnly
+
+		case "verbose":
+			app.Verbose = true
+
+		case "restart_on_cfg_change":
+			app.RestartOnCfgChange = true
+
+		default:
+			return d.Errf("unrecognized consul_ingress option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddyfile.Unmarshaler = (*CaddyConsulIngress)(nil)
+)
@@ -1,46 +1,171 @@
 package caddyconsulingress
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/fortix/caddy-consul-ingress/config"
+	"github.com/fortix/caddy-consul-ingress/parser"
 
 	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
 	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
 
 func init() {
 	caddycmd.RegisterCommand(caddycmd.Command{
 		Name:  "consul-ingress",
-		Func:  commandFunc,
-		Usage: "<command>",
 		Short: "Run caddy as an ingress controller for a Consul / Nomad cluster",
-		Flags: func() *flag.FlagSet {
-			fs := flag.NewFlagSet("consul-ingress", flag.ExitOnError)
-
-			fs.String("template", "t", "A template file that the Caddyfile is generated from")
-			fs.String("consul-address", "http://localhost:8500", "Address of the Consul server")
-			fs.String("consul-token", "", "Access token for Consul")
-			fs.String("urlprefix", "urlprefix-", "Prefix for the tags defining service URLs")
-			fs.Duration("polling-interval", 30*time.Second, "Interval caddy should manually check consul for updated services")
-			fs.String("kvpath", "/caddy-routes", "Path to the Consul KV store for custom routes")
-			fs.String("wildcard-domains", "", "Space separated list of wildcard domains to group services by")
-			fs.Bool("verbose", false, "Set the log level to debug")
-			fs.Bool("restart-on-cfg-change", false, "Restart caddy when the Caddyfile changes")
-
-			return fs
-		}(),
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.Flags().AddGoFlagSet(ingressFlags())
+			cmd.RunE = caddycmd.WrapCommandFuncForCobra(commandFunc)
+
+			resyncCmd := &cobra.Command{
+				Use:   "resync [--config <path> [--adapter <name>]] [--address <interface>]",
+				Short: "Re-read the services from Consul and reload the config of the running ingress",
+				Long: `
+Makes the running ingress re-read the services from the Consul catalog and KV
+store and reload the generated config, even if it has not changed. The status
+of the ingress after the reload is printed.
+
+The admin endpoint is loaded from the --address flag if specified; otherwise
+it is loaded from the given config file; otherwise the default is assumed.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdResync),
+			}
+			resyncCmd.Flags().StringP("config", "c", "", "Configuration file to read the admin address from")
+			resyncCmd.Flags().StringP("adapter", "a", "", "Name of config adapter to apply")
+			resyncCmd.Flags().String("address", "", "Address of the administration listener, if different from config")
+			cmd.AddCommand(resyncCmd)
+
+			renderCmd := &cobra.Command{
+				Use:   "render --fixture <path> [--adapt] [flags]",
+				Short: "Print the config generated from a fixture of services and KV routes without Consul",
+				Long: `
+Generates the config from the services and KV routes in a JSON or YAML fixture
+instead of Consul and prints it, for developing templates and reviewing changes
+to the tags. The fixture has the form:
+
+  services:
+    <name>:
+      tags: [<tag>, ...]
+      meta: {<key>: <value>, ...}
+      instances: [<address:port>, ...]
+  kv:
+    <key>: <routes>
+
+The other flags and environment variables are the same as when running the
+ingress. With --adapt a Caddyfile is adapted and the JSON printed instead, any
+warnings from the adapter are logged.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdRender),
+			}
+			renderCmd.Flags().AddGoFlagSet(ingressFlags())
+			renderCmd.Flags().String("fixture", "", "JSON or YAML file of the services and KV routes (required)")
+			renderCmd.Flags().Bool("adapt", false, "Print the config adapted to JSON")
+			cmd.AddCommand(renderCmd)
+
+			validateCmd := &cobra.Command{
+				Use:   "validate [--fixture <path>] [flags]",
+				Short: "Check the service tags, meta and KV routes for problems",
+				Long: `
+Reads the services and KV routes from Consul, or from a fixture in the same
+form as the render command, and prints every tag, option or route which is
+ignored or may not route as intended along with the service name or KV key
+and line it came from. This includes malformed KV routes, unknown or invalid
+options, invalid hostnames, URLs routed to by more than one service and URLs
+under a wildcard domain which the wildcard doesn't match.
+
+The other flags and environment variables are the same as when running the
+ingress. Exits with a non-zero status if any problems are found.
+`,
+				RunE: caddycmd.WrapCommandFuncForCobra(cmdValidate),
+			}
+			validateCmd.Flags().AddGoFlagSet(ingressFlags())
+			validateCmd.Flags().String("fixture", "", "JSON or YAML file of the services and KV routes to check instead of Consul")
+			cmd.AddCommand(validateCmd)
+		},
 	})
 }
 
+// Flags setting the options of the ingress
+func ingressFlags() *flag.FlagSet {
+	fs := flag.NewFlagSet("consul-ingress", flag.ExitOnError)
+
+	fs.String("template", "", "A template file that the Caddyfile is generated from, defaults to the built in template")
+	fs.String("consul-address", "", "Address of the Consul server, defaults to CONSUL_HTTP_ADDR or http://localhost:8500")
+	fs.String("consul-token", "", "Access token for Consul, defaults to CONSUL_HTTP_TOKEN")
+	fs.String("consul-ca-file", "", "CA certificate file to verify Consul with, defaults to CONSUL_CACERT")
+	fs.String("consul-ca-path", "", "Directory of CA certificates to verify Consul with, defaults to CONSUL_CAPATH")
+	fs.String("consul-cert-file", "", "Client certificate file to authenticate with Consul, defaults to CONSUL_CLIENT_CERT")
+	fs.String("consul-key-file", "", "Client key file to authenticate with Consul, defaults to CONSUL_CLIENT_KEY")
+	fs.String("consul-tls-server-name", "", "Server name to verify the Consul certificate against, defaults to CONSUL_TLS_SERVER_NAME")
+	fs.Bool("consul-tls-skip-verify", false, "Skip verifying the Consul certificate")
+	fs.String("datacenters", "", "Space separated list of datacenters to read services and routes from, * for all, defaults to the datacenter of the Consul agent")
+	fs.String("failover-datacenters", "", "Space separated list of datacenters to use the instances of a service from in order when it has no healthy instances, unless set by the failover option")
+	fs.String("namespaces", "", "Space separated list of Consul Enterprise namespaces to read services and routes from, * for all, defaults to the namespace of the token")
+	fs.String("partitions", "", "Space separated list of Consul Enterprise admin partitions to read services and routes from, * for all, defaults to the partition of the token")
+	fs.String("urlprefix", "urlprefix-", "Prefix for the tags defining service URLs")
+	fs.String("metaprefix", "caddy-", "Prefix for the service meta keys defining service URLs and options, empty to disable")
+	fs.Duration("polling-interval", 30*time.Second, "Interval caddy should manually check consul for updated services")
+	fs.Duration("debounce", time.Second, "Wait for changes in Consul to settle for this long before updating the config, 0 to update on every change")
+	fs.Duration("debounce-max-delay", 10*time.Second, "Update the config at most this long after the first of a burst of changes, 0 for no limit")
+	fs.String("upstreams", config.UpstreamModeSrv, "How service upstreams are resolved, srv for Consul DNS, health for the Consul health API or consul for the consul upstreams module")
+	fs.String("config-format", config.ConfigFormatCaddyfile, "How the config is generated, caddyfile from the template or json directly without a template")
+	fs.String("conflict-policy", config.ConflictPolicyFirst, "How services claiming the same URL are resolved, first by name, kv routes over the catalog, highest priority option or merge into a pool of upstreams")
+	fs.Bool("passing-only", true, "Only route to instances passing their health checks when upstreams are from the health API or consul module")
+	fs.String("kvpath", "/caddy-routes", "Path to the Consul KV store for custom routes")
+	fs.String("storage-prefix", "", "Prefix of the Consul KV keys to store certificates, keys and locks under so replicas share them, empty to keep them on disk")
+	fs.String("leader-key", "", "KV key of the lock electing a leader among the replicas sharing it, empty to disable leader election")
+	fs.String("wildcard-domains", "", "Space separated list of wildcard domains to group services by")
+	fs.Bool("verbose", false, "Set the log level to debug")
+	fs.Bool("restart-on-cfg-change", false, "Restart caddy when the Caddyfile changes")
+
+	return fs
+}
+
 func commandFunc(flags caddycmd.Flags) (int, error) {
 	caddy.TrapSignals()
 
-	// Process options
+	options := parseOptions(flags)
+
+	// Run caddy with the ingress app, the app replaces the config with the generated one as services change
+	app := NewCaddyConsulIngress(options)
+
+	options.Logger.Info("Start caddy admin")
+	err := caddy.Run(&caddy.Config{
+		Admin: &caddy.AdminConfig{
+			Listen: "tcp/localhost:2019",
+		},
+		AppsRaw: caddy.ModuleMap{
+			"consul_ingress": caddyconfig.JSON(app, nil),
+		},
+	})
+	if err != nil {
+		return 1, err
+	}
+
+	select {}
+}
+
+// Process the options from the flags with the defaults and validation of the app, for commands which run without it
+func commandOptions(flags caddycmd.Flags) (*config.Options, error) {
+	options := parseOptions(flags)
+	return NewCaddyConsulIngress(options).options(options.Logger)
+}
+
+// Process the options from the flags, environment variables take precedence
+func parseOptions(flags caddycmd.Flags) *config.Options {
 	options := &config.Options{}
 
 	if templateFileEnv := os.Getenv("CONSUL_INGRESS_TEMPLATE"); templateFileEnv != "" {
@@ -61,18 +186,91 @@ func commandFunc(flags caddycmd.Flags) (int, error) {
 		options.ConsulToken = flags.String("consul-token")
 	}
 
+	if consulCAFileEnv := os.Getenv("CONSUL_INGRESS_CONSUL_CA_FILE"); consulCAFileEnv != "" {
+		options.ConsulCAFile = consulCAFileEnv
+	} else {
+		options.ConsulCAFile = flags.String("consul-ca-file")
+	}
+
+	if consulCAPathEnv := os.Getenv("CONSUL_INGRESS_CONSUL_CA_PATH"); consulCAPathEnv != "" {
+		options.ConsulCAPath = consulCAPathEnv
+	} else {
+		options.ConsulCAPath = flags.String("consul-ca-path")
+	}
+
+	if consulCertFileEnv := os.Getenv("CONSUL_INGRESS_CONSUL_CERT_FILE"); consulCertFileEnv != "" {
+		options.ConsulCertFile = consulCertFileEnv
+	} else {
+		options.ConsulCertFile = flags.String("consul-cert-file")
+	}
+
+	if consulKeyFileEnv := os.Getenv("CONSUL_INGRESS_CONSUL_KEY_FILE"); consulKeyFileEnv != "" {
+		options.ConsulKeyFile = consulKeyFileEnv
+	} else {
+		options.ConsulKeyFile = flags.String("consul-key-file")
+	}
+
+	if consulTLSServerNameEnv := os.Getenv("CONSUL_INGRESS_CONSUL_TLS_SERVER_NAME"); consulTLSServerNameEnv != "" {
+		options.ConsulTLSServerName = consulTLSServerNameEnv
+	} else {
+		options.ConsulTLSServerName = flags.String("consul-tls-server-name")
+	}
+
+	if datacentersEnv := os.Getenv("CONSUL_INGRESS_DATACENTERS"); datacentersEnv != "" {
+		options.Datacenters = strings.Fields(datacentersEnv)
+	} else {
+		options.Datacenters = strings.Fields(flags.String("datacenters"))
+	}
+
+	if failoverDatacentersEnv := os.Getenv("CONSUL_INGRESS_FAILOVER_DATACENTERS"); failoverDatacentersEnv != "" {
+		options.FailoverDatacenters = strings.Fields(failoverDatacentersEnv)
+	} else {
+		options.FailoverDatacenters = strings.Fields(flags.String("failover-datacenters"))
+	}
+
+	if namespacesEnv := os.Getenv("CONSUL_INGRESS_NAMESPACES"); namespacesEnv != "" {
+		options.Namespaces = strings.Fields(namespacesEnv)
+	} else {
+		options.Namespaces = strings.Fields(flags.String("namespaces"))
+	}
+
+	if partitionsEnv := os.Getenv("CONSUL_INGRESS_PARTITIONS"); partitionsEnv != "" {
+		options.Partitions = strings.Fields(partitionsEnv)
+	} else {
+		options.Partitions = strings.Fields(flags.String("partitions"))
+	}
+
 	if urlPrefixEnv := os.Getenv("CONSUL_INGRESS_URLPREFIX"); urlPrefixEnv != "" {
 		options.UrlPrefix = urlPrefixEnv
 	} else {
 		options.UrlPrefix = flags.String("urlprefix")
 	}
 
+	// An empty prefix disables meta, so the variable is used whenever it is set
+	if metaPrefixEnv, ok := os.LookupEnv("CONSUL_INGRESS_META_PREFIX"); ok {
+		options.MetaPrefix = metaPrefixEnv
+	} else {
+		options.MetaPrefix = flags.String("metaprefix")
+	}
+
 	if kvPathEnv := os.Getenv("CONSUL_INGRESS_KV_PATH"); kvPathEnv != "" {
 		options.KVPath = kvPathEnv
 	} else {
 		options.KVPath = flags.String("kvpath")
 	}
 
+	if storagePrefixEnv := os.Getenv("CONSUL_INGRESS_STORAGE_PREFIX"); storagePrefixEnv != "" {
+		options.StoragePrefix = storagePrefixEnv
+	} else {
+		options.StoragePrefix = flags.String("storage-prefix")
+	}
+
+	if leaderKeyEnv := os.Getenv("CONSUL_INGRESS_LEADER_KEY"); leaderKeyEnv != "" {
+		options.LeaderKey = leaderKeyEnv
+	} else {
+		options.LeaderKey = flags.String("leader-key")
+	}
+
 	if wildcardDomainsEnv := os.Getenv("CONSUL_INGRESS_WILDCARD_DOMAINS"); wildcardDomainsEnv != "" {
 		options.WildcardDomains = strings.Split(wildcardDomainsEnv, " ")
 	} else {
@@ -91,8 +289,48 @@ func commandFunc(flags caddycmd.Flags) (int, error) {
 		options.RestartOnCfgChange = flags.Bool("restart-on-cfg-change")
 	}
 
+	if upstreamModeEnv := os.Getenv("CONSUL_INGRESS_UPSTREAMS"); upstreamModeEnv != "" {
+		options.UpstreamMode = upstreamModeEnv
+	} else {
+		options.UpstreamMode = flags.String("upstreams")
+	}
+
+	if configFormatEnv := os.Getenv("CONSUL_INGRESS_CONFIG_FORMAT"); configFormatEnv != "" {
+		options.ConfigFormat = configFormatEnv
+	} else {
+		options.ConfigFormat = flags.String("config-format")
+	}
+
+	if conflictPolicyEnv := os.Getenv("CONSUL_INGRESS_CONFLICT_POLICY"); conflictPolicyEnv != "" {
+		options.ConflictPolicy = conflictPolicyEnv
+	} else {
+		options.ConflictPolicy = flags.String("conflict-policy")
+	}
+
 	options.Logger = caddy.Log().Named("consul-ingress")
 
+	if passingOnlyEnv := os.Getenv("CONSUL_INGRESS_PASSING_ONLY"); passingOnlyEnv != "" {
+		if p, err := strconv.ParseBool(passingOnlyEnv); err != nil {
+			options.Logger.Error("Failed to parse CONSUL_INGRESS_PASSING_ONLY", zap.String("CONSUL_INGRESS_PASSING_ONLY", passingOnlyEnv), zap.Error(err))
+			options.HealthPassingOnly = flags.Bool("passing-only")
+		} else {
+			options.HealthPassingOnly = p
+		}
+	} else {
+		options.HealthPassingOnly = flags.Bool("passing-only")
+	}
+
+	if consulTLSSkipVerifyEnv := os.Getenv("CONSUL_INGRESS_CONSUL_TLS_SKIP_VERIFY"); consulTLSSkipVerifyEnv != "" {
+		if s, err := strconv.ParseBool(consulTLSSkipVerifyEnv); err != nil {
+			options.Logger.Error("Failed to parse CONSUL_INGRESS_CONSUL_TLS_SKIP_VERIFY", zap.String("CONSUL_INGRESS_CONSUL_TLS_SKIP_VERIFY", consulTLSSkipVerifyEnv), zap.Error(err))
+			options.ConsulTLSSkipVerify = flags.Bool("consul-tls-skip-verify")
+		} else {
+			options.ConsulTLSSkipVerify = s
+		}
+	} else {
+		options.ConsulTLSSkipVerify = flags.Bool("consul-tls-skip-verify")
+	}
+
 	if pollingIntervalEnv := os.Getenv("CONSUL_INGRESS_POLLING_INTERVAL"); pollingIntervalEnv != "" {
 		if p, err := time.ParseDuration(pollingIntervalEnv); err != nil {
 			options.Logger.Error("Failed to parse CONSUL_INGRESS_POLLING_INTERVAL", zap.String("CONSUL_INGRESS_POLLING_INTERVAL", pollingIntervalEnv), zap.Error(err))
@@ -104,24 +342,131 @@ func commandFunc(flags caddycmd.Flags) (int, error) {
 		options.PollingInterval = flags.Duration("polling-interval")
 	}
 
-	options.Logger.Info("Start caddy admin")
-	err := caddy.Run(&caddy.Config{
-		Admin: &caddy.AdminConfig{
-			Listen: "tcp/localhost:2019",
-		},
-	})
+	if debounceEnv := os.Getenv("CONSUL_INGRESS_DEBOUNCE"); debounceEnv != "" {
+		if d, err := time.ParseDuration(debounceEnv); err != nil {
+			options.Logger.Error("Failed to parse CONSUL_INGRESS_DEBOUNCE", zap.String("CONSUL_INGRESS_DEBOUNCE", debounceEnv), zap.Error(err))
+			options.DebounceWindow = flags.Duration("debounce")
+		} else {
+			options.DebounceWindow = d
+		}
+	} else {
+		options.DebounceWindow = flags.Duration("debounce")
+	}
+
+	if debounceMaxDelayEnv := os.Getenv("CONSUL_INGRESS_DEBOUNCE_MAX_DELAY"); debounceMaxDelayEnv != "" {
+		if d, err := time.ParseDuration(debounceMaxDelayEnv); err != nil {
+			options.Logger.Error("Failed to parse CONSUL_INGRESS_DEBOUNCE_MAX_DELAY", zap.String("CONSUL_INGRESS_DEBOUNCE_MAX_DELAY", debounceMaxDelayEnv), zap.Error(err))
+			options.DebounceMaxDelay = flags.Duration("debounce-max-delay")
+		} else {
+			options.DebounceMaxDelay = d
+		}
+	} else {
+		options.DebounceMaxDelay = flags.Duration("debounce-max-delay")
+	}
+
+	return options
+}
+
+// Ask the running ingress to resync with Consul through the admin API
+func cmdResync(flags caddycmd.Flags) (int, error) {
+	adminAddr, err := caddycmd.DetermineAdminAPIAddress(flags.String("address"), nil, flags.String("config"), flags.String("adapter"))
 	if err != nil {
-		return 1, err
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("couldn't determine admin API address: %v", err)
+	}
+
+	resp, err := caddycmd.AdminAPIRequest(adminAddr, http.MethodPost, "/consul-ingress/resync", nil, nil)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
 	}
+	defer resp.Body.Close()
 
-	client := NewConsulIngressClient(options)
-	if err := client.Start(); err != nil {
-		if err := caddy.Stop(); err != nil {
-			return 1, err
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// Print the config generated from a fixture without contacting Consul
+func cmdRender(flags caddycmd.Flags) (int, error) {
+	fixturePath := flags.String("fixture")
+	if fixturePath == "" {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("no fixture file given")
+	}
+
+	fixture, err := LoadFixture(fixturePath)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	options, err := commandOptions(flags)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	client := NewConsulIngressClient(options, nil)
+
+	cfg, err := client.Render(fixture)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	if flags.Bool("adapt") {
+		cfgJSON, warn, err := client.adapt(cfg)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		for _, w := range warn {
+			options.Logger.Warn(w.String())
 		}
+		cfg = cfgJSON
+	}
 
-		return 1, err
+	// Indent the JSON so changes can be reviewed as a diff
+	if options.ConfigFormat == config.ConfigFormatJSON || flags.Bool("adapt") {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, cfg, "", "  "); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		indented.WriteByte('\n')
+		cfg = indented.Bytes()
 	}
 
-	select {}
+	if _, err := os.Stdout.Write(cfg); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// Print the problems found in the services and KV routes
+func cmdValidate(flags caddycmd.Flags) (int, error) {
+	options, err := commandOptions(flags)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	client := NewConsulIngressClient(options, nil)
+
+	// The problems are printed so the parser doesn't need to log them as well
+	strictParser := parser.NewStrictParser(zap.NewNop(), options)
+
+	if fixturePath := flags.String("fixture"); fixturePath != "" {
+		fixture, err := LoadFixture(fixturePath)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		client.parseFixture(strictParser, fixture)
+	} else if _, _, err := client.readConsul(strictParser); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	diagnostics := strictParser.Diagnostics()
+	for _, diagnostic := range diagnostics {
+		fmt.Println(diagnostic)
+	}
+
+	if len(diagnostics) > 0 {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("found %d problems", len(diagnostics))
+	}
+
+	return caddy.ExitCodeSuccess, nil
 }
@@ -6,16 +6,65 @@ import (
 	"go.uber.org/zap"
 )
 
+// Upstreams resolve to the SRV records in Consul DNS
+const UpstreamModeSrv = "srv"
+
+// Upstreams are the instances returned by the Consul health API
+const UpstreamModeHealth = "health"
+
+// Upstreams are resolved at request time by the consul upstreams module
+const UpstreamModeConsul = "consul"
+
+// Config is generated from the template and adapted with the Caddyfile adapter
+const ConfigFormatCaddyfile = "caddyfile"
+
+// Config is generated directly as Caddy JSON, the template is not used
+const ConfigFormatJSON = "json"
+
+// Services claiming the same URL are resolved to the first by name
+const ConflictPolicyFirst = "first"
+
+// Services claiming the same URL are resolved to the KV route, then the first by name
+const ConflictPolicyKV = "kv"
+
+// Services claiming the same URL are resolved to the highest priority option, then the first by name
+const ConflictPolicyPriority = "priority"
+
+// Services claiming the same URL are merged into a single pool of upstreams where possible, otherwise the first by name
+const ConflictPolicyMerge = "merge"
+
+// Datacenters, namespaces or partitions matching every one in Consul
+const ScopeAll = "*"
+
 // Options are the options for generator
 type Options struct {
-	TemplateFile       string
-	ConsulAddress      string
-	ConsulToken        string
-	UrlPrefix          string
-	KVPath             string
-	WildcardDomains    []string
-	PollingInterval    time.Duration
-	Verbose            bool
-	RestartOnCfgChange bool
-	Logger             *zap.Logger
+	TemplateFile        string
+	ConsulAddress       string
+	ConsulToken         string
+	ConsulCAFile        string
+	ConsulCAPath        string
+	ConsulCertFile      string
+	ConsulKeyFile       string
+	ConsulTLSServerName string
+	ConsulTLSSkipVerify bool
+	Datacenters         []string
+	FailoverDatacenters []string
+	Namespaces          []string
+	Partitions          []string
+	UrlPrefix           string
+	MetaPrefix          string
+	KVPath              string
+	StoragePrefix       string
+	LeaderKey           string
+	WildcardDomains     []string
+	PollingInterval     time.Duration
+	DebounceWindow      time.Duration
+	DebounceMaxDelay    time.Duration
+	UpstreamMode        string
+	ConfigFormat        string
+	ConflictPolicy      string
+	HealthPassingOnly   bool
+	Verbose             bool
+	RestartOnCfgChange  bool
+	Logger              *zap.Logger
 }
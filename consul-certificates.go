@@ -0,0 +1,254 @@
+package caddyconsulingress
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	consul "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+// Watchers of the certificates in the KV store shared between config reloads, keyed by the connection settings and KV key
+var certificateWatchers = caddy.NewUsagePool()
+
+type certificateWatchKey struct {
+	Consul consulSettings
+	Key    string
+}
+
+// ConsulCertificates serves the certificate stored in a key of the Consul KV store during TLS handshakes.
+//
+// The key holds the PEM encoded certificate chain followed by the private key. It is watched with blocking
+// queries so a renewed certificate is served without reloading the config. While the key is missing or can't
+// be parsed no certificate is returned, and Caddy obtains one as it would without this module.
+type ConsulCertificates struct {
+	// KV key of the certificate chain and private key
+	Key string `json:"key,omitempty"`
+
+	// Address of the Consul server, defaults to the ingress setting
+	Address string `json:"address,omitempty"`
+
+	// Access token for Consul, defaults to the ingress setting
+	Token string `json:"token,omitempty"`
+
+	watchKey certificateWatchKey
+	watcher  *certificateWatcher
+}
+
+// CaddyModule returns the Caddy module information.
+func (ConsulCertificates) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.get_certificate.consul",
+		New: func() caddy.Module { return new(ConsulCertificates) },
+	}
+}
+
+func (c *ConsulCertificates) Provision(ctx caddy.Context) error {
+	c.Key = strings.Trim(c.Key, "/")
+	if c.Key == "" {
+		return fmt.Errorf("consul certificates require a key")
+	}
+
+	// The TLS app may be provisioned before the ingress app which sets the default settings
+	if err := provisionIngressApp(ctx); err != nil {
+		return err
+	}
+
+	storageMutex.Lock()
+	settings := defaultStorage
+	storageMutex.Unlock()
+
+	if c.Address != "" {
+		settings.Address = c.Address
+	}
+	if c.Token != "" {
+		settings.Token = c.Token
+	}
+
+	c.watchKey = certificateWatchKey{Consul: settings, Key: c.Key}
+	watcher, _, err := certificateWatchers.LoadOrNew(c.watchKey, func() (caddy.Destructor, error) {
+		consulClient, err := consul.NewClient(settings.config())
+		if err != nil {
+			return nil, err
+		}
+		return newCertificateWatcher(ctx.Logger(), consulClient, c.Key), nil
+	})
+	if err != nil {
+		return err
+	}
+	c.watcher = watcher.(*certificateWatcher)
+
+	return nil
+}
+
+func (c *ConsulCertificates) Cleanup() error {
+	if c.watcher != nil {
+		_, err := certificateWatchers.Delete(c.watchKey)
+		return err
+	}
+	return nil
+}
+
+// Returns the certificate last read from the key, nil if there isn't one
+func (c *ConsulCertificates) GetCertificate(_ context.Context, _ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.watcher.Certificate(), nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	get_certificate consul [<key>] {
+//	    key     <key>
+//	    address <address>
+//	    token   <token>
+//	}
+func (c *ConsulCertificates) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume certificate manager name
+
+	args := d.RemainingArgs()
+	if len(args) > 1 {
+		return d.ArgErr()
+	}
+	if len(args) > 0 {
+		c.Key = args[0]
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "key":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Key = d.Val()
+
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Address = d.Val()
+
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			c.Token = d.Val()
+
+		default:
+			return d.Errf("unrecognized consul certificates option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// Watches a key of the KV store holding a certificate chain and private key
+type certificateWatcher struct {
+	mutex  sync.RWMutex
+	logger *zap.Logger
+	consul *consul.Client
+	key    string
+	cancel context.CancelFunc
+	cert   *tls.Certificate
+}
+
+// Read the certificate and watch the key for changes, the first read completes before returning so handshakes have the certificate
+func newCertificateWatcher(logger *zap.Logger, consulClient *consul.Client, key string) *certificateWatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	w := &certificateWatcher{
+		mutex:  sync.RWMutex{},
+		logger: logger,
+		consul: consulClient,
+		key:    key,
+		cancel: cancel,
+		cert:   nil,
+	}
+
+	// Don't hold up provisioning for long if Consul can't be reached, the watch retries
+	fetchCtx, fetchCancel := context.WithTimeout(ctx, 10*time.Second)
+	defer fetchCancel()
+
+	params := &consul.QueryOptions{RequireConsistent: true}
+	w.fetch(fetchCtx, params)
+	go w.watch(ctx, params)
+
+	return w
+}
+
+// Returns the certificate last read from the key
+func (w *certificateWatcher) Certificate() *tls.Certificate {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	return w.cert
+}
+
+// Stop watching once no config uses the key
+func (w *certificateWatcher) Destruct() error {
+	w.cancel()
+	return nil
+}
+
+// Watch the key until cancelled
+func (w *certificateWatcher) watch(ctx context.Context, params *consul.QueryOptions) {
+	for {
+		if !w.fetch(ctx, params) {
+			if !sleep(ctx, 5*time.Second) { // Wait before retrying
+				return
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// Read the key, waiting for a change once it has been read, and parse the certificate. Returns false if Consul couldn't be queried.
+func (w *certificateWatcher) fetch(ctx context.Context, params *consul.QueryOptions) bool {
+	pair, meta, err := w.consul.KV().Get(w.key, params.WithContext(ctx))
+	if err != nil {
+		if ctx.Err() == nil || ctx.Err() == context.DeadlineExceeded {
+			w.logger.Error("Failed to read certificate from Consul", zap.String("key", w.key), zap.Error(err))
+		}
+		return false
+	}
+
+	if meta.LastIndex == params.WaitIndex {
+		return true
+	}
+	params.WaitIndex = meta.LastIndex
+
+	var cert *tls.Certificate
+	if pair == nil {
+		w.logger.Warn("Certificate not found in Consul", zap.String("key", w.key))
+	} else {
+		// The value holds both the certificate chain and the key, each is picked out by its PEM block type
+		parsed, err := tls.X509KeyPair(pair.Value, pair.Value)
+		if err != nil {
+			w.logger.Error("Failed to parse certificate from Consul", zap.String("key", w.key), zap.Error(err))
+			return true
+		}
+		cert = &parsed
+		w.logger.Info("Loaded certificate from Consul", zap.String("key", w.key))
+	}
+
+	w.mutex.Lock()
+	w.cert = cert
+	w.mutex.Unlock()
+
+	return true
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner     = (*ConsulCertificates)(nil)
+	_ caddy.CleanerUpper    = (*ConsulCertificates)(nil)
+	_ certmagic.Manager     = (*ConsulCertificates)(nil)
+	_ caddyfile.Unmarshaler = (*ConsulCertificates)(nil)
+)
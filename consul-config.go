@@ -0,0 +1,111 @@
+package caddyconsulingress
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Clients shared between config reloads, keyed by the connection settings and closed once no config uses them
+var consulClients = caddy.NewUsagePool()
+
+// A client in consulClients
+type sharedConsulClient struct {
+	client    *consul.Client
+	transport *http.Transport
+}
+
+// Close the idle connections once no config uses the client
+func (c *sharedConsulClient) Destruct() error {
+	c.transport.CloseIdleConnections()
+	return nil
+}
+
+// Returns the client shared by modules with the same connection settings, each call must be matched by deleting the settings from consulClients
+func sharedConsulClientFor(settings consulSettings) (*consul.Client, error) {
+	client, _, err := consulClients.LoadOrNew(settings, func() (caddy.Destructor, error) {
+		consulConfig := settings.config()
+		client, err := consul.NewClient(consulConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &sharedConsulClient{client: client, transport: consulConfig.Transport}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return client.(*sharedConsulClient).client, nil
+}
+
+// Provision the ingress app of the config if it has one and it isn't yet, so modules provisioned before it
+// such as the storage use its connection settings as their defaults
+func provisionIngressApp(ctx caddy.Context) error {
+	_, err := ctx.AppIfConfigured("consul_ingress")
+	if errors.Is(err, caddy.ErrNotConfigured) {
+		return nil
+	}
+	return err
+}
+
+// Settings of a connection to Consul, comparable so connections with the same settings can be shared
+type consulSettings struct {
+	Address       string
+	Token         string
+	CAFile        string
+	CAPath        string
+	CertFile      string
+	KeyFile       string
+	TLSServerName string
+	TLSSkipVerify bool
+}
+
+// Returns the settings of the connection to Consul from the options
+func consulSettingsFromOptions(options *config.Options) consulSettings {
+	return consulSettings{
+		Address:       options.ConsulAddress,
+		Token:         options.ConsulToken,
+		CAFile:        options.ConsulCAFile,
+		CAPath:        options.ConsulCAPath,
+		CertFile:      options.ConsulCertFile,
+		KeyFile:       options.ConsulKeyFile,
+		TLSServerName: options.ConsulTLSServerName,
+		TLSSkipVerify: options.ConsulTLSSkipVerify,
+	}
+}
+
+// Config of the Consul client, settings which aren't given fall back to the standard CONSUL_HTTP_* environment variables
+func (s consulSettings) config() *consul.Config {
+	consulConfig := consul.DefaultConfig()
+
+	if s.Address != "" {
+		consulConfig.Address = s.Address
+	}
+	if s.Token != "" {
+		consulConfig.Token = s.Token
+	}
+	if s.CAFile != "" {
+		consulConfig.TLSConfig.CAFile = s.CAFile
+	}
+	if s.CAPath != "" {
+		consulConfig.TLSConfig.CAPath = s.CAPath
+	}
+	if s.CertFile != "" {
+		consulConfig.TLSConfig.CertFile = s.CertFile
+	}
+	if s.KeyFile != "" {
+		consulConfig.TLSConfig.KeyFile = s.KeyFile
+	}
+	if s.TLSServerName != "" {
+		consulConfig.TLSConfig.Address = s.TLSServerName
+	}
+	if s.TLSSkipVerify {
+		consulConfig.TLSConfig.InsecureSkipVerify = true
+	}
+
+	return consulConfig
+}
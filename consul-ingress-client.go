@@ -1,10 +1,20 @@
 package caddyconsulingress
 
 import (
+	"context"
 	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fortix/caddy-consul-ingress/config"
@@ -13,191 +23,935 @@ import (
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
 	consul "github.com/hashicorp/consul/api"
 	"go.uber.org/zap"
 )
 
 var CaddyfileAutosavePath = filepath.Join(caddy.AppConfigDir(), "Caddyfile.autosave")
+var JSONAutosavePath = filepath.Join(caddy.AppConfigDir(), "consul-ingress.autosave.json")
+
+// Services without meta for the ingress are re-read at least this often, so meta added without changing their tags is picked up
+const metaRefreshInterval = 5 * time.Minute
 
 type ConsulIngressClient struct {
-	mutex             sync.Mutex
+	mutex             sync.Mutex // Held while updating the config
+	stateMutex        sync.Mutex // Held while reading or updating the services and status
+	startOnce         sync.Once
+	ctx               context.Context
+	cancel            context.CancelFunc
+	appConfig         json.RawMessage
 	options           *config.Options
 	logger            *zap.Logger
+	consul            *consul.Client // Shared by the watchers, taken from consulClients on first use
 	parser            *parser.ServiceParser
 	generator         *generator.CaddyfileGenerator
+	jsonGenerator     *generator.JSONGenerator
 	lastCaddyfileHash string
+	lastConfig        []byte
+	baseConfig        []byte      // Config loaded from outside the ingress which generated configs are merged into
+	loading           atomic.Bool // Set while the client loads a config into Caddy
+	lastCaddyfile     []byte
+	failedCaddyfile   []byte
+	lastError         error
+	lastSync          time.Time
+	conflicts         []parser.Conflict
+	synced            bool
+	changes           chan struct{}
+	scopes            []parser.Scope
+	catalogs          map[parser.Scope]parser.Catalog
+	kvRoutes          map[parser.Scope]parser.KVRoutes
+	indexes           map[string]uint64 // Consul index of the catalog or KV routes recorded for each watcher
 	serviceDefs       *parser.Services
 	kvServiceDefs     *parser.Services
+	watches           map[string]WatchStatus
+	health            *HealthWatcher
+	election          ElectionStatus
+	electionDone      chan struct{}
 }
 
-func NewConsulIngressClient(options *config.Options) *ConsulIngressClient {
+// Create a client, appConfig is the config of the app running the client which is added to every generated config
+func NewConsulIngressClient(options *config.Options, appConfig json.RawMessage) *ConsulIngressClient {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &ConsulIngressClient{
 		mutex:             sync.Mutex{},
+		stateMutex:        sync.Mutex{},
+		startOnce:         sync.Once{},
+		ctx:               ctx,
+		cancel:            cancel,
+		appConfig:         appConfig,
 		options:           options,
 		logger:            options.Logger,
+		consul:            nil,
 		parser:            parser.NewParser(options.Logger, options),
 		generator:         generator.NewGenerator(options.Logger, options),
+		jsonGenerator:     generator.NewJSONGenerator(options.Logger, options),
 		lastCaddyfileHash: "",
+		lastConfig:        nil,
+		baseConfig:        nil,
+		lastCaddyfile:     nil,
+		failedCaddyfile:   nil,
+		lastError:         nil,
+		lastSync:          time.Time{},
+		conflicts:         nil,
+		synced:            false,
+		changes:           make(chan struct{}, 1),
+		scopes:            nil,
+		catalogs:          make(map[parser.Scope]parser.Catalog),
+		kvRoutes:          make(map[parser.Scope]parser.KVRoutes),
+		indexes:           make(map[string]uint64),
 		serviceDefs:       nil,
 		kvServiceDefs:     nil,
+		watches:           make(map[string]WatchStatus),
+		health:            nil,
+		election:          ElectionStatus{Key: options.LeaderKey},
+		electionDone:      nil,
 	}
 }
 
+// Start watching Consul, the client is shared between config reloads so only the first call starts it
 func (ingressClient *ConsulIngressClient) Start() error {
+	var err error
+	ingressClient.startOnce.Do(func() {
+		err = ingressClient.start()
+	})
+	return err
+}
+
+// Stop watching Consul
+func (ingressClient *ConsulIngressClient) Stop() {
+	ingressClient.logger.Info("Stopping Consul Ingress Client")
+
+	ingressClient.cancel()
+	if ingressClient.health != nil {
+		ingressClient.health.Stop()
+	}
+
+	// Give the leader lock a moment to be released so another replica can take over without waiting for the session to expire
+	if ingressClient.electionDone != nil {
+		select {
+		case <-ingressClient.electionDone:
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	ingressClient.releaseConsulClient()
+}
+
+// Destruct stops the client once no config is using it
+func (ingressClient *ConsulIngressClient) Destruct() error {
+	ingressClient.Stop()
+	return nil
+}
+
+func (ingressClient *ConsulIngressClient) start() error {
 	ingressClient.logger.Info("Starting Consul Ingress Client")
 
-	consulConfig := &consul.Config{
-		Address: ingressClient.options.ConsulAddress,
-		Token:   ingressClient.options.ConsulToken,
+	// Watch the health of the routed services to generate upstreams from the healthy instances
+	if ingressClient.options.UpstreamMode == config.UpstreamModeHealth {
+		consulClient, err := ingressClient.consulClient()
+		if err != nil {
+			return err
+		}
+
+		ingressClient.health = NewHealthWatcher(ingressClient.logger, consulClient, ingressClient.options.HealthPassingOnly, ingressClient.options.PollingInterval, func() {
+			ingressClient.scheduleUpdate()
+		})
 	}
 
-	// Start a goroutine to watch for changes in Consul services
-	ingressClient.logger.Info("Watch for changes in Consul services")
-	go func() {
-		params := &consul.QueryOptions{
-			WaitIndex:         0,
-			WaitTime:          ingressClient.options.PollingInterval,
-			AllowStale:        false,
-			RequireConsistent: true,
+	// Serve the last config until synced with Consul, loaded in the background as the app is started during a config load
+	go ingressClient.loadAutosave(ingressClient.logger)
+
+	// Coalesce the changes from all the watchers into updates of the config
+	go ingressClient.runUpdates()
+
+	// Watch the catalog and KV store of each namespace and partition
+	go ingressClient.watchScopes()
+
+	// Elect one of the replicas sharing the leader key to perform side effects
+	if ingressClient.options.LeaderKey != "" {
+		ingressClient.electionDone = make(chan struct{})
+		go ingressClient.runElection()
+	} else {
+		observeLeader(true)
+	}
+
+	return nil
+}
+
+// Watch the services registered in the catalog of the scope until the context is cancelled
+func (ingressClient *ConsulIngressClient) watchCatalog(ctx context.Context, scope parser.Scope) {
+	ingressClient.logger.Info("Watch for changes in Consul services", zap.Stringer("scope", scope))
+
+	watcher := watchName(watcherCatalog, scope)
+	params := scope.QueryOptions()
+	params.WaitTime = ingressClient.options.PollingInterval
+	params.RequireConsistent = true
+
+	// The last catalog read, its instances are reused for services which haven't changed
+	var previous *parser.Catalog
+	var lastFullRead time.Time
+
+	for {
+		consulClient, err := ingressClient.consulClient()
+		if err != nil {
+			ingressClient.logger.Warn("Failed to create Consul client", zap.Error(err))
+			if !sleep(ctx, 5*time.Second) { // Wait before attempting reconnection
+				return
+			}
+			continue
 		}
 
 		for {
-			consulClient, err := consul.NewClient(consulConfig)
+			services, meta, err := consulClient.Catalog().Services(params.WithContext(ctx))
+			if ctx.Err() == nil {
+				observeConsulRequest(watcherCatalog, meta, err)
+				ingressClient.setWatchStatus(watcher, meta, err)
+			}
 			if err != nil {
-				ingressClient.logger.Warn("Failed to create Consul client", zap.Error(err))
-				time.Sleep(5 * time.Second) // Wait before attempting reconnection
-				continue
+				if ctx.Err() == nil {
+					ingressClient.logger.Error("Failed to retrieve services from Consul", zap.Stringer("scope", scope), zap.Error(err))
+				}
+				break
 			}
 
-			for {
-				services, meta, err := consulClient.Catalog().Services(params)
+			if meta.LastIndex > params.WaitIndex {
+				cached := previous
+				if time.Since(lastFullRead) >= metaRefreshInterval {
+					cached = nil
+				}
+
+				instances, err := ingressClient.fetchServiceInstances(ctx, consulClient, scope, services, cached)
 				if err != nil {
-					ingressClient.logger.Error("Failed to retrieve services from Consul", zap.Error(err))
+					if ctx.Err() == nil {
+						ingressClient.logger.Error("Failed to retrieve service instances from Consul", zap.Stringer("scope", scope), zap.Error(err))
+					}
 					break
 				}
+				if cached == nil {
+					lastFullRead = time.Now()
+				}
+
+				params.WaitIndex = meta.LastIndex
+
+				previous = &parser.Catalog{
+					Scope:     scope,
+					Services:  services,
+					Instances: instances,
+				}
+				ingressClient.setCatalog(ctx, *previous, meta.LastIndex)
+
+				ingressClient.scheduleUpdate()
+			}
+
+			// Continue from the catalog read by a resync if it's newer
+			if catalog, index := ingressClient.newerCatalog(scope, params.WaitIndex); catalog != nil {
+				params.WaitIndex = index
+				previous = catalog
+			}
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Connection to Consul lost, attempt reconnection
+		ingressClient.logger.Warn("Connection to Consul lost, attempting reconnection...")
+		if !sleep(ctx, 5*time.Second) { // Wait before attempting reconnection
+			return
+		}
+	}
+}
 
-				if meta.LastIndex > params.WaitIndex {
-					params.WaitIndex = meta.LastIndex
+// Watch the routes in the KV store of the scope until the context is cancelled
+func (ingressClient *ConsulIngressClient) watchKV(ctx context.Context, scope parser.Scope) {
+	ingressClient.logger.Info("Watch for changes in Consul Key Value store", zap.Stringer("scope", scope))
 
-					ingressClient.serviceDefs = ingressClient.parser.ParseServices(services)
+	watcher := watchName(watcherKV, scope)
+	params := scope.QueryOptions()
+	params.WaitTime = ingressClient.options.PollingInterval
+	params.RequireConsistent = true
 
-					ingressClient.updateCaddyfile(ingressClient.logger)
+	for {
+		consulClient, err := ingressClient.consulClient()
+		if err != nil {
+			ingressClient.logger.Warn("Failed to create Consul client", zap.Error(err))
+			if !sleep(ctx, 5*time.Second) { // Wait before attempting reconnection
+				return
+			}
+			continue
+		}
+
+		for {
+			kvPairs, meta, err := consulClient.KV().List(ingressClient.options.KVPath, params.WithContext(ctx))
+			if ctx.Err() == nil {
+				observeConsulRequest(watcherKV, meta, err)
+				ingressClient.setWatchStatus(watcher, meta, err)
+			}
+			if err != nil {
+				if ctx.Err() == nil {
+					ingressClient.logger.Error("Failed to retrieve KV pairs from Consul", zap.Stringer("scope", scope), zap.Error(err))
 				}
+				break
+			}
+
+			if meta.LastIndex > params.WaitIndex {
+				params.WaitIndex = meta.LastIndex
+
+				ingressClient.setKVRoutes(ctx, parser.KVRoutes{
+					Scope: scope,
+					Pairs: kvPairs,
+				}, meta.LastIndex)
+
+				ingressClient.scheduleUpdate()
 			}
 
-			// Connection to Consul lost, attempt reconnection
-			ingressClient.logger.Warn("Connection to Consul lost, attempting reconnection...")
-			time.Sleep(5 * time.Second) // Wait before attempting reconnection
+			// Continue from the routes read by a resync if they're newer
+			params.WaitIndex = ingressClient.kvRoutesIndex(scope, params.WaitIndex)
 		}
-	}()
 
-	// Start a goroutine to watch for changes in Consul KV store
-	if ingressClient.options.KVPath != "" {
-		ingressClient.logger.Info("Watch for changes in Consul Key Value store")
-		go func() {
-			params := &consul.QueryOptions{
-				WaitIndex:         0,
-				WaitTime:          ingressClient.options.PollingInterval,
-				AllowStale:        false,
-				RequireConsistent: true,
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Connection to Consul lost, attempt reconnection
+		ingressClient.logger.Warn("Connection to Consul lost, attempting reconnection...")
+		if !sleep(ctx, 5*time.Second) { // Wait before attempting reconnection
+			return
+		}
+	}
+}
+
+// Request an update of the config, bursts of requests are coalesced by runUpdates
+func (ingressClient *ConsulIngressClient) scheduleUpdate() {
+	select {
+	case ingressClient.changes <- struct{}{}:
+	default: // An update is already pending
+	}
+}
+
+// Update the config once no changes have been seen for the debounce window, or the max delay has passed since the first change
+func (ingressClient *ConsulIngressClient) runUpdates() {
+	for {
+		select {
+		case <-ingressClient.ctx.Done():
+			return
+		case <-ingressClient.changes:
+		}
+
+		if ingressClient.options.DebounceWindow > 0 {
+			window := time.NewTimer(ingressClient.options.DebounceWindow)
+
+			var maxDelay <-chan time.Time
+			if ingressClient.options.DebounceMaxDelay > 0 {
+				maxDelay = time.After(ingressClient.options.DebounceMaxDelay)
 			}
 
+		debounce:
 			for {
-				consulClient, err := consul.NewClient(consulConfig)
-				if err != nil {
-					ingressClient.logger.Warn("Failed to create Consul client", zap.Error(err))
-					time.Sleep(5 * time.Second) // Wait before attempting reconnection
-					continue
+				select {
+				case <-ingressClient.ctx.Done():
+					window.Stop()
+					return
+				case <-ingressClient.changes:
+					window.Reset(ingressClient.options.DebounceWindow)
+				case <-window.C:
+					break debounce
+				case <-maxDelay:
+					window.Stop()
+					break debounce
 				}
+			}
+		}
 
-				for {
-					kvPairs, meta, err := consulClient.KV().List(ingressClient.options.KVPath, params)
-					if err != nil {
-						ingressClient.logger.Error("Failed to retrieve KV pairs from Consul", zap.Error(err))
-						break
-					}
+		ingressClient.updateCaddyfile(ingressClient.logger, false)
+	}
+}
 
-					if meta.LastIndex > params.WaitIndex {
-						params.WaitIndex = meta.LastIndex
+// Re-read the services from Consul and reload the config even if it hasn't changed, returns the error if the config couldn't be loaded
+func (ingressClient *ConsulIngressClient) Resync() error {
+	ingressClient.logger.Info("Resyncing with Consul")
 
-						ingressClient.kvServiceDefs = ingressClient.parser.ParseKV(&kvPairs)
+	snapshot, err := ingressClient.readSnapshot()
+	if err != nil {
+		return err
+	}
+	serviceDefs, kvServiceDefs := ingressClient.parseSnapshot(ingressClient.parser, snapshot)
 
-						ingressClient.updateCaddyfile(ingressClient.logger)
-					}
-				}
+	// Record what was read so the next change seen by a watcher doesn't bring back the state from before the resync
+	ingressClient.stateMutex.Lock()
+	ingressClient.recordSnapshot(snapshot)
+	ingressClient.serviceDefs = serviceDefs
+	ingressClient.kvServiceDefs = kvServiceDefs
+	ingressClient.stateMutex.Unlock()
 
-				// Connection to Consul lost, attempt reconnection
-				ingressClient.logger.Warn("Connection to Consul lost, attempting reconnection...")
-				time.Sleep(5 * time.Second) // Wait before attempting reconnection
-			}
-		}()
+	return ingressClient.updateCaddyfile(ingressClient.logger, true)
+}
+
+// The catalog and KV routes of every scope read at once, with the Consul index of each keyed by the name of its watcher
+type consulSnapshot struct {
+	catalogs []parser.Catalog
+	kvRoutes []parser.KVRoutes
+	indexes  map[string]uint64
+}
+
+// Read the current services from the catalog and KV store of every scope with the parser
+func (ingressClient *ConsulIngressClient) readConsul(p *parser.ServiceParser) (*parser.Services, *parser.Services, error) {
+	snapshot, err := ingressClient.readSnapshot()
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return nil
+	serviceDefs, kvServiceDefs := ingressClient.parseSnapshot(p, snapshot)
+	return serviceDefs, kvServiceDefs, nil
 }
 
-func (ingressClient *ConsulIngressClient) updateCaddyfile(log *zap.Logger) {
+// Read the current catalog and KV routes of every scope
+func (ingressClient *ConsulIngressClient) readSnapshot() (*consulSnapshot, error) {
+	consulClient, err := ingressClient.consulClient()
+	if err != nil {
+		return nil, err
+	}
 
-	// Acquire the lock
-	ingressClient.mutex.Lock()
-	defer ingressClient.mutex.Unlock()
+	scopes, err := ingressClient.resolveScopes(consulClient)
+	if err != nil {
+		return nil, &consulError{Err: err}
+	}
 
-	// Generate Caddyfile from services
-	caddyfile := ingressClient.generator.Generate(ingressClient.serviceDefs, ingressClient.kvServiceDefs)
+	snapshot := &consulSnapshot{indexes: make(map[string]uint64)}
+	for _, scope := range scopes {
+		// Query without an index so the current state is returned rather than waiting for a change
+		params := scope.QueryOptions()
+		params.RequireConsistent = true
+		params = params.WithContext(ingressClient.ctx)
 
-	// Calculate md5 hash of the generated Caddyfile
-	md5Hash := md5.New()
-	md5Hash.Write([]byte(caddyfile))
-	caddyfileHash := string(md5Hash.Sum(nil))
+		services, meta, err := consulClient.Catalog().Services(params)
+		observeConsulRequest(watcherCatalog, meta, err)
+		ingressClient.setWatchStatus(watchName(watcherCatalog, scope), meta, err)
+		if err != nil {
+			return nil, &consulError{Err: fmt.Errorf("failed to retrieve services from Consul: %w", err)}
+		}
 
-	if ingressClient.lastCaddyfileHash != string(caddyfileHash) {
-		ingressClient.lastCaddyfileHash = caddyfileHash
+		instances, err := ingressClient.fetchServiceInstances(ingressClient.ctx, consulClient, scope, services, nil)
+		if err != nil {
+			return nil, &consulError{Err: fmt.Errorf("failed to retrieve service instances from Consul: %w", err)}
+		}
+		snapshot.catalogs = append(snapshot.catalogs, parser.Catalog{Scope: scope, Services: services, Instances: instances})
+		snapshot.indexes[watchName(watcherCatalog, scope)] = meta.LastIndex
 
-		// Save the generated Caddyfile to disk
-		if autosaveErr := os.WriteFile(CaddyfileAutosavePath, []byte(caddyfile), 0666); autosaveErr != nil {
-			log.Warn("Failed to autosave caddyfile", zap.Error(autosaveErr), zap.String("path", CaddyfileAutosavePath))
+		if ingressClient.options.KVPath != "" {
+			kvPairs, meta, err := consulClient.KV().List(ingressClient.options.KVPath, params)
+			observeConsulRequest(watcherKV, meta, err)
+			ingressClient.setWatchStatus(watchName(watcherKV, scope), meta, err)
+			if err != nil {
+				return nil, &consulError{Err: fmt.Errorf("failed to retrieve KV pairs from Consul: %w", err)}
+			}
+			snapshot.kvRoutes = append(snapshot.kvRoutes, parser.KVRoutes{Scope: scope, Pairs: kvPairs})
+			snapshot.indexes[watchName(watcherKV, scope)] = meta.LastIndex
 		}
+	}
 
-		// Convert the Caddyfile to JSON
-		adapter := caddyconfig.GetAdapter("caddyfile")
-		json, warn, err := adapter.Adapt([]byte(caddyfile), nil)
+	return snapshot, nil
+}
+
+// Parse the services and KV routes read from Consul with the parser
+func (ingressClient *ConsulIngressClient) parseSnapshot(p *parser.ServiceParser, snapshot *consulSnapshot) (*parser.Services, *parser.Services) {
+	serviceDefs := p.ParseCatalogs(snapshot.catalogs)
+
+	var kvServiceDefs *parser.Services
+	if ingressClient.options.KVPath != "" {
+		kvServiceDefs = p.ParseKVRoutes(snapshot.kvRoutes)
+	}
+
+	return serviceDefs, kvServiceDefs
+}
+
+// Returned when Consul couldn't be queried
+type consulError struct {
+	Err error
+}
+
+func (e *consulError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *consulError) Unwrap() error {
+	return e.Err
+}
+
+// Returns the client connecting to Consul, shared between the watchers and reconnects so connections are reused
+func (ingressClient *ConsulIngressClient) consulClient() (*consul.Client, error) {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	// A watcher reconnecting after the client stopped would take a client which is never released
+	if err := ingressClient.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if ingressClient.consul == nil {
+		consulClient, err := sharedConsulClientFor(consulSettingsFromOptions(ingressClient.options))
 		if err != nil {
-			log.Error("Failed to adapt Caddyfile", zap.Error(err))
-			return
+			return nil, err
 		}
+		ingressClient.consul = consulClient
+	}
+	return ingressClient.consul, nil
+}
+
+// Release the client connecting to Consul, its idle connections are closed once nothing else uses it
+func (ingressClient *ConsulIngressClient) releaseConsulClient() {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	if ingressClient.consul != nil {
+		_, _ = consulClients.Delete(consulSettingsFromOptions(ingressClient.options))
+		ingressClient.consul = nil
+	}
+}
+
+// Sleep for the duration, returns false if the context was cancelled while sleeping
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
 
-		if ingressClient.options.Verbose {
-			log.Info("Caddyfile", zap.String("caddyfile", string(json)))
+// Fetch the instances of each service in the scope so the parser can read the service meta, skipped if meta is disabled.
+// The instances in cached are reused for services whose tags haven't changed and which have no meta for the ingress, nil fetches every service.
+func (ingressClient *ConsulIngressClient) fetchServiceInstances(ctx context.Context, consulClient *consul.Client, scope parser.Scope, services map[string][]string, cached *parser.Catalog) (map[string][]*consul.CatalogService, error) {
+	instances := make(map[string][]*consul.CatalogService)
+	if ingressClient.options.MetaPrefix == "" {
+		return instances, nil
+	}
 
-			if warn != nil {
-				log.Warn("Warnings", zap.Any("warnings", warn))
+	for service, tags := range services {
+		if cached != nil {
+			if cachedInstances, ok := cached.Instances[service]; ok && slices.Equal(cached.Services[service], tags) && !ingressClient.hasIngressMeta(cachedInstances) {
+				instances[service] = cachedInstances
+				continue
 			}
 		}
 
-		// Restart Caddy if the Caddyfile has changed
-		if ingressClient.options.RestartOnCfgChange {
-			// Restart caddy to break in flight connections
-			log.Info("Restarting Caddy")
-			caddy.Stop()
-			err = caddy.Run(&caddy.Config{
-				Admin: &caddy.AdminConfig{
-					Listen: "tcp/localhost:2019",
-				},
-			})
-			if err != nil {
-				log.Fatal("Failed to start Caddy", zap.Error(err))
+		serviceInstances, meta, err := consulClient.Catalog().Service(service, "", scope.QueryOptions().WithContext(ctx))
+		if ctx.Err() == nil {
+			observeConsulRequest(watcherInstance, meta, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		instances[service] = serviceInstances
+	}
+
+	return instances, nil
+}
+
+// Returns true if any of the instances has a meta key starting with the meta prefix
+func (ingressClient *ConsulIngressClient) hasIngressMeta(instances []*consul.CatalogService) bool {
+	for _, instance := range instances {
+		for key := range instance.ServiceMeta {
+			if strings.HasPrefix(key, ingressClient.options.MetaPrefix) {
+				return true
 			}
 		}
+	}
+	return false
+}
 
-		// Load the JSON into Caddy
-		err = caddy.Load(json, false)
-		if err != nil {
-			log.Error("Failed to load Caddyfile", zap.Error(err))
-			log.Error(caddyfile)
-		} else {
-			log.Info("Successfully loaded Caddyfile")
+// Merge the generated config into the config loaded from outside the ingress, so the sites, apps and global options it sets keep running
+func (ingressClient *ConsulIngressClient) withBaseConfig(cfgJSON []byte) ([]byte, error) {
+	if ingressClient.baseConfig == nil {
+		return cfgJSON, nil
+	}
+
+	return mergeConfig(ingressClient.baseConfig, cfgJSON)
+}
+
+// Read the running config through the admin API and keep it as the base config unless it was loaded by the client,
+// returns true if the base config changed. The running config is kept as is if it can't be read.
+func (ingressClient *ConsulIngressClient) refreshBaseConfig(log *zap.Logger) bool {
+	if ingressClient.appConfig == nil {
+		return false
+	}
+
+	adminAddr := adminAddress(ingressClient.lastConfig)
+	if adminAddr == "" {
+		adminAddr = adminAddress(ingressClient.baseConfig)
+	}
+	if adminAddr == "" {
+		adminAddr = caddy.DefaultAdminListen
+	}
+
+	resp, err := caddycmd.AdminAPIRequest(adminAddr, http.MethodGet, "/config/", nil, nil)
+	if err != nil {
+		log.Warn("Failed to read the running config from the admin API", zap.Error(err), zap.String("address", adminAddr))
+		return false
+	}
+	defer resp.Body.Close()
+
+	running, err := io.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		log.Warn("Failed to read the running config from the admin API", zap.Error(err), zap.Int("status", resp.StatusCode), zap.String("address", adminAddr))
+		return false
+	}
+
+	if sameConfig(running, ingressClient.lastConfig) || sameConfig(running, ingressClient.baseConfig) {
+		return false
+	}
+
+	log.Info("Merging generated configs into the loaded config")
+	ingressClient.baseConfig = running
+	return true
+}
+
+// Returns the admin address set by a config, empty if it doesn't set one
+func adminAddress(cfgJSON []byte) string {
+	if cfgJSON == nil {
+		return ""
+	}
+
+	var cfg caddy.Config
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil || cfg.Admin == nil {
+		return ""
+	}
+	return cfg.Admin.Listen
+}
+
+// Add the config of the app running the client to the generated config, so loading it keeps the client running
+func (ingressClient *ConsulIngressClient) withAppConfig(cfgJSON []byte) ([]byte, error) {
+	if ingressClient.appConfig == nil {
+		return cfgJSON, nil
+	}
+
+	var cfg map[string]json.RawMessage
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return nil, err
+	}
+
+	apps := make(map[string]json.RawMessage)
+	if appsJSON, ok := cfg["apps"]; ok {
+		if err := json.Unmarshal(appsJSON, &apps); err != nil {
+			return nil, err
 		}
+	}
+
+	apps["consul_ingress"] = ingressClient.appConfig
+
+	appsJSON, err := json.Marshal(apps)
+	if err != nil {
+		return nil, err
+	}
+	cfg["apps"] = appsJSON
+
+	return json.Marshal(cfg)
+}
+
+// Store certificates in the Consul KV store if a storage prefix is set, unless the generated config sets its own storage
+func (ingressClient *ConsulIngressClient) withStorage(cfgJSON []byte) ([]byte, error) {
+	if ingressClient.options.StoragePrefix == "" {
+		return cfgJSON, nil
+	}
+
+	var cfg map[string]json.RawMessage
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return nil, err
+	}
+
+	if _, ok := cfg["storage"]; ok {
+		return cfgJSON, nil
+	}
+
+	cfg["storage"] = caddyconfig.JSONModuleObject(ConsulStorage{Prefix: ingressClient.options.StoragePrefix}, "module", "consul", nil)
+
+	return json.Marshal(cfg)
+}
+
+// Generate the Caddyfile or JSON config from services, returns the config and the services claiming the same URL
+func (ingressClient *ConsulIngressClient) generate(serviceDefs *parser.Services, kvServiceDefs *parser.Services, instances map[string][]string) ([]byte, []parser.Conflict, error) {
+	var cfg []byte
+	var conflicts []parser.Conflict
+	var err error
+	if ingressClient.options.ConfigFormat == config.ConfigFormatJSON {
+		cfg, conflicts, err = ingressClient.jsonGenerator.Generate(serviceDefs, kvServiceDefs, instances)
 	} else {
+		var caddyfile string
+		caddyfile, conflicts, err = ingressClient.generator.Generate(serviceDefs, kvServiceDefs, instances)
+		cfg = []byte(caddyfile)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, conflict := range conflicts {
+		ingressClient.logger.Warn("Services conflict", zap.Stringer("conflict", conflict))
+	}
+
+	return cfg, conflicts, nil
+}
+
+// Path the generated config is saved to after it has been loaded
+func (ingressClient *ConsulIngressClient) autosavePath() string {
+	if ingressClient.options.ConfigFormat == config.ConfigFormatJSON {
+		return JSONAutosavePath
+	}
+	return CaddyfileAutosavePath
+}
+
+// Convert the generated config to JSON ready to load, the JSON generator output is used as is
+func (ingressClient *ConsulIngressClient) adapt(caddyfile []byte) ([]byte, []caddyconfig.Warning, error) {
+	cfgJSON := caddyfile
+	var warn []caddyconfig.Warning
+	if ingressClient.options.ConfigFormat != config.ConfigFormatJSON {
+		var err error
+		adapter := caddyconfig.GetAdapter("caddyfile")
+		cfgJSON, warn, err = adapter.Adapt(caddyfile, nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to adapt Caddyfile: %w", err)
+		}
+	}
+
+	cfgJSON, err := ingressClient.withBaseConfig(cfgJSON)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to merge into the loaded config: %w", err)
+	}
+
+	cfgJSON, err = ingressClient.withAppConfig(cfgJSON)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to add the app config: %w", err)
+	}
+
+	cfgJSON, err = ingressClient.withStorage(cfgJSON)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to add the storage: %w", err)
+	}
+
+	return cfgJSON, warn, nil
+}
+
+// Load the config saved after the last successful sync, so the sites are served until Consul can be reached
+func (ingressClient *ConsulIngressClient) loadAutosave(log *zap.Logger) {
+
+	// Acquire the lock
+	ingressClient.mutex.Lock()
+	defer ingressClient.mutex.Unlock()
+
+	// Nothing to do once the client has been stopped or synced with Consul
+	if ingressClient.ctx.Err() != nil || ingressClient.synced {
+		return
+	}
+
+	autosavePath := ingressClient.autosavePath()
+	caddyfile, err := os.ReadFile(autosavePath)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Warn("Failed to read autosaved config", zap.Error(err), zap.String("path", autosavePath))
+		}
+		return
+	}
+
+	// Serve the saved sites alongside the loaded config
+	ingressClient.refreshBaseConfig(log)
+
+	cfgJSON, _, err := ingressClient.adapt(caddyfile)
+	if err != nil {
+		log.Warn("Failed to adapt autosaved config", zap.Error(err), zap.String("path", autosavePath))
+		return
+	}
+
+	err = ingressClient.loadConfig(cfgJSON, false)
+	if err != nil {
+		log.Warn("Failed to load autosaved config", zap.Error(err), zap.String("path", autosavePath))
+		return
+	}
+
+	// Skip the reload if the first sync generates the same config
+	md5Hash := md5.Sum(caddyfile)
+	ingressClient.lastCaddyfileHash = string(md5Hash[:])
+	ingressClient.lastConfig = cfgJSON
+	ingressClient.setLoaded(caddyfile, ingressClient.lastCaddyfileHash)
+
+	log.Info("Loaded autosaved config until synced with Consul", zap.String("path", autosavePath))
+}
+
+// Generate the config from the services and load it if changed, force reloads it even if unchanged.
+// Returns the error if the config couldn't be generated or loaded, nil if there was nothing to do.
+func (ingressClient *ConsulIngressClient) updateCaddyfile(log *zap.Logger, force bool) error {
+
+	// Acquire the lock
+	ingressClient.mutex.Lock()
+	defer ingressClient.mutex.Unlock()
+
+	// Nothing to do once the client has been stopped
+	if ingressClient.ctx.Err() != nil {
+		return nil
+	}
+
+	ingressClient.stateMutex.Lock()
+	serviceDefs := ingressClient.serviceDefs
+	kvServiceDefs := ingressClient.kvServiceDefs
+	ingressClient.stateMutex.Unlock()
+
+	// Keep serving the current config until the services have been read from Consul, otherwise sites would be dropped
+	if serviceDefs == nil || (ingressClient.options.KVPath != "" && kvServiceDefs == nil) {
+		log.Info("Waiting for the first sync with Consul")
+		return nil
+	}
+	ingressClient.synced = true
+
+	ingressMetrics.updates.Inc()
+	defer func(start time.Time) {
+		ingressMetrics.updateDuration.Observe(time.Since(start).Seconds())
+	}(time.Now())
+
+	observeServices(serviceDefs, kvServiceDefs)
+
+	// Update the watched services and get their healthy instances
+	var instances map[string][]string
+	if ingressClient.health != nil {
+		ingressClient.health.Watch(parser.FailoverServiceRefs(serviceDefs, kvServiceDefs))
+		instances = ingressClient.health.Instances()
+	}
+
+	// Generate the Caddyfile or JSON config from services
+	caddyfile, conflicts, err := ingressClient.generate(serviceDefs, kvServiceDefs, instances)
+	if err != nil {
+		// Keep serving the current config until the template or services are fixed
+		ingressClient.setFailure(nil, err)
+		ingressMetrics.failures.WithLabelValues(stageGenerate).Inc()
+		log.Error("Failed to generate config", zap.Error(err))
+		return err
+	}
+	ingressClient.setConflicts(conflicts)
+
+	// Calculate md5 hash of the generated config
+	md5Hash := md5.New()
+	md5Hash.Write(caddyfile)
+	caddyfileHash := string(md5Hash.Sum(nil))
+
+	// A config loaded from outside the ingress has replaced the generated one, so the generated config is merged into it and loaded again
+	baseChanged := ingressClient.refreshBaseConfig(log)
+
+	if !force && !baseChanged && ingressClient.lastCaddyfileHash == caddyfileHash {
+		ingressClient.setSynced()
 		log.Info("Caddyfile has not changed, skipping reload")
+		return nil
 	}
+
+	cfgJSON, err := ingressClient.load(log, caddyfile, force)
+	if err != nil {
+		// Keep the failed config for inspection, it is retried on the next change as the hash is left unchanged
+		ingressClient.setFailure(caddyfile, err)
+
+		log.Error("Failed to load Caddyfile", zap.Error(err))
+		log.Error(string(caddyfile))
+
+		ingressClient.rollback(log)
+		return err
+	}
+
+	ingressClient.lastCaddyfileHash = caddyfileHash
+	ingressClient.lastConfig = cfgJSON
+	ingressClient.setLoaded(caddyfile, caddyfileHash)
+	ingressClient.setSynced()
+
+	log.Info("Successfully loaded Caddyfile")
+
+	// Save the loaded config to disk so it can be served on startup if Consul is unreachable
+	autosavePath := ingressClient.autosavePath()
+	if autosaveErr := os.MkdirAll(filepath.Dir(autosavePath), 0700); autosaveErr != nil {
+		log.Warn("Failed to autosave caddyfile", zap.Error(autosaveErr), zap.String("path", autosavePath))
+	} else if autosaveErr := os.WriteFile(autosavePath, caddyfile, 0600); autosaveErr != nil {
+		log.Warn("Failed to autosave caddyfile", zap.Error(autosaveErr), zap.String("path", autosavePath))
+	}
+
+	return nil
+}
+
+// Adapt the generated config and load it into Caddy, returns the loaded JSON. Force loads it even if it matches the running config
+func (ingressClient *ConsulIngressClient) load(log *zap.Logger, caddyfile []byte, force bool) ([]byte, error) {
+	cfgJSON, warn, err := ingressClient.adapt(caddyfile)
+	if err != nil {
+		ingressMetrics.failures.WithLabelValues(stageAdapt).Inc()
+		return nil, err
+	}
+
+	if ingressClient.options.Verbose {
+		log.Info("Caddyfile", zap.String("caddyfile", string(cfgJSON)))
+
+		if warn != nil {
+			log.Warn("Warnings", zap.Any("warnings", warn))
+		}
+	}
+
+	// Restart Caddy if the Caddyfile has changed
+	if ingressClient.options.RestartOnCfgChange {
+		// Check the config before stopping Caddy, a config failing after the restart leaves nothing running until rolled back
+		var cfg caddy.Config
+		if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+			ingressMetrics.failures.WithLabelValues(stageLoad).Inc()
+			return nil, err
+		}
+		if err := caddy.Validate(&cfg); err != nil {
+			ingressMetrics.failures.WithLabelValues(stageLoad).Inc()
+			return nil, err
+		}
+
+		// Hold a reference to the client so stopping the app doesn't stop the client
+		clients.LoadOrStore(string(ingressClient.appConfig), ingressClient)
+		defer clients.Delete(string(ingressClient.appConfig))
+
+		// Restart caddy to break in flight connections
+		log.Info("Restarting Caddy")
+		caddy.Stop()
+		err = caddy.Run(&caddy.Config{
+			Admin: &caddy.AdminConfig{
+				Listen: "tcp/localhost:2019",
+			},
+		})
+		if err != nil {
+			log.Fatal("Failed to start Caddy", zap.Error(err))
+		}
+	}
+
+	// Load the JSON into Caddy
+	if err := ingressClient.loadConfig(cfgJSON, force); err != nil {
+		ingressMetrics.failures.WithLabelValues(stageLoad).Inc()
+		return nil, err
+	}
+
+	return cfgJSON, nil
+}
+
+// Load a config into Caddy, the app provisioned by the load knows not to schedule another update
+func (ingressClient *ConsulIngressClient) loadConfig(cfgJSON []byte, force bool) error {
+	ingressClient.loading.Store(true)
+	defer ingressClient.loading.Store(false)
+
+	return caddy.Load(cfgJSON, force)
+}
+
+// Called when a config with the app is provisioned, a config loaded from outside the ingress may lack the generated sites
+// so an update merges them into it. Loads by the client are skipped, a failed load would otherwise be retried in a loop.
+func (ingressClient *ConsulIngressClient) provisioned() {
+	if !ingressClient.loading.Load() {
+		ingressClient.scheduleUpdate()
+	}
+}
+
+// Re-apply the last config which loaded successfully, Caddy keeps the running config when a load fails but not after a restart
+func (ingressClient *ConsulIngressClient) rollback(log *zap.Logger) {
+	if ingressClient.lastConfig == nil {
+		return
+	}
+
+	if err := ingressClient.loadConfig(ingressClient.lastConfig, false); err != nil {
+		log.Error("Failed to roll back to the last loaded config", zap.Error(err))
+		return
+	}
+
+	log.Info("Rolled back to the last loaded config")
 }
@@ -0,0 +1,110 @@
+package caddyconsulingress
+
+import (
+	"os"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+// Sessions of leaders are invalidated this long after Consul stops hearing from them
+const leaderSessionTTL = "15s"
+
+// State of the leader election between the replicas sharing the leader key
+type ElectionStatus struct {
+	Key       string     `json:"key"`
+	Leader    bool       `json:"leader"`
+	Since     *time.Time `json:"since,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// Campaign for the leader lock until the client is stopped, every replica generates and serves the config whether it leads or not
+func (ingressClient *ConsulIngressClient) runElection() {
+	defer close(ingressClient.electionDone)
+
+	ingressClient.logger.Info("Campaign for leadership", zap.String("key", ingressClient.options.LeaderKey))
+
+	// Record which replica holds the lock as its value
+	hostname, _ := os.Hostname()
+
+	for {
+		consulClient, err := ingressClient.consulClient()
+		if err == nil {
+			var lock *consul.Lock
+			lock, err = consulClient.LockOpts(&consul.LockOptions{
+				Key:            ingressClient.options.LeaderKey,
+				Value:          []byte(hostname),
+				SessionName:    "caddy-consul-ingress",
+				SessionTTL:     leaderSessionTTL,
+				MonitorRetries: 3, // Ride out brief Consul errors rather than giving up leadership
+			})
+			if err == nil {
+				err = ingressClient.lead(lock)
+			}
+		}
+
+		if ingressClient.ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			ingressClient.logger.Error("Failed to campaign for leadership", zap.Error(err))
+			ingressMetrics.consulErrors.WithLabelValues(watcherLeader).Inc()
+		}
+		ingressClient.setLeader(false, err)
+
+		if !sleep(ingressClient.ctx, 5*time.Second) { // Wait before campaigning again
+			return
+		}
+	}
+}
+
+// Acquire the lock and hold it until it is lost or the client is stopped, released on stopping so another replica takes over
+func (ingressClient *ConsulIngressClient) lead(lock *consul.Lock) error {
+	lostCh, err := lock.Lock(ingressClient.ctx.Done())
+	if err != nil {
+		return err
+	}
+	if lostCh == nil { // Stopped while waiting for the lock
+		return nil
+	}
+
+	ingressClient.logger.Info("Acquired leadership", zap.String("key", ingressClient.options.LeaderKey))
+	ingressClient.setLeader(true, nil)
+
+	select {
+	case <-lostCh:
+		ingressClient.logger.Warn("Lost leadership", zap.String("key", ingressClient.options.LeaderKey))
+	case <-ingressClient.ctx.Done():
+		ingressClient.logger.Info("Releasing leadership", zap.String("key", ingressClient.options.LeaderKey))
+	}
+
+	// Stops renewing the session, the lock may already have been lost so the error is ignored
+	_ = lock.Unlock()
+	ingressClient.setLeader(false, nil)
+
+	return nil
+}
+
+// Record whether the client holds the leader lock and the last error campaigning for it
+func (ingressClient *ConsulIngressClient) setLeader(leader bool, err error) {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	if leader != ingressClient.election.Leader {
+		ingressClient.election.Leader = leader
+		ingressClient.election.Since = nil
+		if leader {
+			since := time.Now()
+			ingressClient.election.Since = &since
+		}
+	}
+	if err != nil {
+		ingressClient.election.LastError = err.Error()
+	} else if leader {
+		ingressClient.election.LastError = ""
+	}
+
+	observeLeader(leader)
+}
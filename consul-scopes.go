@@ -0,0 +1,290 @@
+package caddyconsulingress
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+	"github.com/fortix/caddy-consul-ingress/parser"
+
+	consul "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+// Name of the watcher of a scope in the status, watchers of the default scope are just the watcher
+func watchName(watcher string, scope parser.Scope) string {
+	if name := scope.String(); name != "" {
+		return watcher + ":" + name
+	}
+	return watcher
+}
+
+// Watch the catalog and KV store of each scope, when watching all datacenters, namespaces or partitions they are listed every polling interval
+func (ingressClient *ConsulIngressClient) watchScopes() {
+	watches := make(map[parser.Scope]context.CancelFunc)
+
+	listed := slices.Contains(ingressClient.options.Datacenters, config.ScopeAll) ||
+		slices.Contains(ingressClient.options.Namespaces, config.ScopeAll) ||
+		slices.Contains(ingressClient.options.Partitions, config.ScopeAll)
+
+	for {
+		interval := ingressClient.options.PollingInterval
+
+		consulClient, err := ingressClient.consulClient()
+		if err == nil {
+			var scopes []parser.Scope
+			scopes, err = ingressClient.resolveScopes(consulClient)
+			if err == nil {
+				ingressClient.updateScopes(scopes, watches)
+			}
+		}
+		if err != nil {
+			if ingressClient.ctx.Err() != nil {
+				return
+			}
+			ingressClient.logger.Error("Failed to list the datacenters, namespaces and partitions to watch", zap.Error(err))
+			interval = 5 * time.Second // Wait before retrying
+		} else if !listed {
+			return
+		}
+
+		if !sleep(ingressClient.ctx, interval) {
+			return
+		}
+	}
+}
+
+// Returns the scopes to read services and routes from, sorted by datacenter, partition then namespace.
+// Without any datacenters the local datacenter is used and without any namespaces or partitions the defaults of the token,
+// * lists all of them from Consul.
+func (ingressClient *ConsulIngressClient) resolveScopes(consulClient *consul.Client) ([]parser.Scope, error) {
+	datacenters := ingressClient.options.Datacenters
+	if len(datacenters) == 0 {
+		datacenters = []string{""}
+	} else if slices.Contains(datacenters, config.ScopeAll) {
+		var err error
+		datacenters, err = consulClient.Catalog().Datacenters()
+		observeConsulRequest(watcherScopes, nil, err)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list datacenters: %w", err)
+		}
+	}
+
+	seen := make(map[parser.Scope]bool)
+	var scopes []parser.Scope
+	for _, datacenter := range datacenters {
+		partitions := ingressClient.options.Partitions
+		if len(partitions) == 0 {
+			partitions = []string{""}
+		} else if slices.Contains(partitions, config.ScopeAll) {
+			list, meta, err := consulClient.Partitions().List(ingressClient.ctx, &consul.QueryOptions{Datacenter: datacenter})
+			observeConsulRequest(watcherScopes, meta, err)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list partitions: %w", err)
+			}
+
+			partitions = make([]string, 0, len(list))
+			for _, partition := range list {
+				partitions = append(partitions, partition.Name)
+			}
+		}
+
+		for _, partition := range partitions {
+			namespaces := ingressClient.options.Namespaces
+			if len(namespaces) == 0 {
+				namespaces = []string{""}
+			} else if slices.Contains(namespaces, config.ScopeAll) {
+				params := &consul.QueryOptions{Datacenter: datacenter, Partition: partition}
+				list, meta, err := consulClient.Namespaces().List(params.WithContext(ingressClient.ctx))
+				observeConsulRequest(watcherScopes, meta, err)
+				if err != nil {
+					return nil, fmt.Errorf("failed to list namespaces: %w", err)
+				}
+
+				namespaces = make([]string, 0, len(list))
+				for _, namespace := range list {
+					namespaces = append(namespaces, namespace.Name)
+				}
+			}
+
+			for _, namespace := range namespaces {
+				scope := parser.Scope{Datacenter: datacenter, Namespace: namespace, Partition: partition}
+				if !seen[scope] {
+					seen[scope] = true
+					scopes = append(scopes, scope)
+				}
+			}
+		}
+	}
+
+	parser.SortScopes(scopes)
+
+	return scopes, nil
+}
+
+// Start watching new scopes and stop watching the scopes which have gone, watches holds the cancel function of each watched scope
+func (ingressClient *ConsulIngressClient) updateScopes(scopes []parser.Scope, watches map[parser.Scope]context.CancelFunc) {
+	wanted := make(map[parser.Scope]bool, len(scopes))
+	for _, scope := range scopes {
+		wanted[scope] = true
+	}
+
+	removed := false
+	for scope, cancel := range watches {
+		if !wanted[scope] {
+			ingressClient.logger.Info("Stop watching scope", zap.Stringer("scope", scope))
+			cancel()
+			delete(watches, scope)
+			removed = true
+		}
+	}
+
+	// Set the scopes before starting the new watchers so the services are parsed once they have all been read
+	ingressClient.stateMutex.Lock()
+	ingressClient.scopes = scopes
+	if removed {
+		for scope := range ingressClient.catalogs {
+			if !wanted[scope] {
+				delete(ingressClient.catalogs, scope)
+				delete(ingressClient.indexes, watchName(watcherCatalog, scope))
+				delete(ingressClient.watches, watchName(watcherCatalog, scope))
+			}
+		}
+		for scope := range ingressClient.kvRoutes {
+			if !wanted[scope] {
+				delete(ingressClient.kvRoutes, scope)
+				delete(ingressClient.indexes, watchName(watcherKV, scope))
+				delete(ingressClient.watches, watchName(watcherKV, scope))
+			}
+		}
+		ingressClient.parseCatalogs()
+		ingressClient.parseKVRoutes()
+	}
+	ingressClient.stateMutex.Unlock()
+
+	for _, scope := range scopes {
+		if _, ok := watches[scope]; ok {
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(ingressClient.ctx)
+		watches[scope] = cancel
+
+		go ingressClient.watchCatalog(ctx, scope)
+		if ingressClient.options.KVPath != "" {
+			go ingressClient.watchKV(ctx, scope)
+		}
+	}
+
+	if removed {
+		ingressClient.scheduleUpdate()
+	}
+}
+
+// Record the services read from the catalog of a scope at the index, ignored once the watch of the scope has been cancelled
+// or if a resync has recorded a newer catalog
+func (ingressClient *ConsulIngressClient) setCatalog(ctx context.Context, catalog parser.Catalog, index uint64) {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	watcher := watchName(watcherCatalog, catalog.Scope)
+	if ctx.Err() != nil || index < ingressClient.indexes[watcher] {
+		return
+	}
+
+	ingressClient.indexes[watcher] = index
+	ingressClient.catalogs[catalog.Scope] = catalog
+	ingressClient.parseCatalogs()
+}
+
+// Record the routes read from the KV store of a scope at the index, ignored once the watch of the scope has been cancelled
+// or if a resync has recorded newer routes
+func (ingressClient *ConsulIngressClient) setKVRoutes(ctx context.Context, kvRoutes parser.KVRoutes, index uint64) {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	watcher := watchName(watcherKV, kvRoutes.Scope)
+	if ctx.Err() != nil || index < ingressClient.indexes[watcher] {
+		return
+	}
+
+	ingressClient.indexes[watcher] = index
+	ingressClient.kvRoutes[kvRoutes.Scope] = kvRoutes
+	ingressClient.parseKVRoutes()
+}
+
+// Returns the catalog of the scope and its index if one newer than the index has been recorded by a resync, nil otherwise
+func (ingressClient *ConsulIngressClient) newerCatalog(scope parser.Scope, index uint64) (*parser.Catalog, uint64) {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	newer := ingressClient.indexes[watchName(watcherCatalog, scope)]
+	catalog, ok := ingressClient.catalogs[scope]
+	if !ok || newer <= index {
+		return nil, index
+	}
+	return &catalog, newer
+}
+
+// Returns the index of the KV routes of the scope, newer than the index if a resync has recorded newer routes
+func (ingressClient *ConsulIngressClient) kvRoutesIndex(scope parser.Scope, index uint64) uint64 {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	return max(index, ingressClient.indexes[watchName(watcherKV, scope)])
+}
+
+// Record the catalogs and KV routes read by a resync which are newer than those recorded by the watchers,
+// the watchers then wait for changes after them. The caller must hold the state lock.
+func (ingressClient *ConsulIngressClient) recordSnapshot(snapshot *consulSnapshot) {
+	for _, catalog := range snapshot.catalogs {
+		watcher := watchName(watcherCatalog, catalog.Scope)
+		if index := snapshot.indexes[watcher]; index >= ingressClient.indexes[watcher] {
+			ingressClient.indexes[watcher] = index
+			ingressClient.catalogs[catalog.Scope] = catalog
+		}
+	}
+
+	for _, kvRoutes := range snapshot.kvRoutes {
+		watcher := watchName(watcherKV, kvRoutes.Scope)
+		if index := snapshot.indexes[watcher]; index >= ingressClient.indexes[watcher] {
+			ingressClient.indexes[watcher] = index
+			ingressClient.kvRoutes[kvRoutes.Scope] = kvRoutes
+		}
+	}
+}
+
+// Parse the services of every scope once they have all been read, the caller must hold the state lock.
+// Until then the services parsed before are kept so the sites of the other scopes aren't dropped.
+func (ingressClient *ConsulIngressClient) parseCatalogs() {
+	catalogs := make([]parser.Catalog, 0, len(ingressClient.scopes))
+	for _, scope := range ingressClient.scopes {
+		catalog, ok := ingressClient.catalogs[scope]
+		if !ok {
+			return
+		}
+		catalogs = append(catalogs, catalog)
+	}
+
+	ingressClient.serviceDefs = ingressClient.parser.ParseCatalogs(catalogs)
+}
+
+// Parse the KV routes of every scope once they have all been read, the caller must hold the state lock
+func (ingressClient *ConsulIngressClient) parseKVRoutes() {
+	if ingressClient.options.KVPath == "" {
+		return
+	}
+
+	kvRoutes := make([]parser.KVRoutes, 0, len(ingressClient.scopes))
+	for _, scope := range ingressClient.scopes {
+		routes, ok := ingressClient.kvRoutes[scope]
+		if !ok {
+			return
+		}
+		kvRoutes = append(kvRoutes, routes)
+	}
+
+	ingressClient.kvServiceDefs = ingressClient.parser.ParseKVRoutes(kvRoutes)
+}
@@ -0,0 +1,329 @@
+package caddyconsulingress
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/certmagic"
+	consul "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+// Prefix of the KV keys storage is kept under when the module doesn't set one
+const defaultStoragePrefix = "caddy-tls"
+
+// Sessions holding storage locks are invalidated this long after Consul stops hearing from the replica holding them
+const storageLockTTL = "30s"
+
+var (
+	storageMutex sync.Mutex
+
+	// Connection settings used by storage and certificate modules that don't set their own, the ingress app sets these when provisioned
+	defaultStorage consulSettings
+
+	// Locks held by storage modules, keyed by the KV key so a lock can be released by the storage of a newer config
+	storageLocks = make(map[string]*consul.Lock)
+)
+
+// Set the connection settings used by storage modules which don't set their own from the ingress options
+func SetStorageDefaults(options *config.Options) {
+	storageMutex.Lock()
+	defer storageMutex.Unlock()
+
+	defaultStorage = consulSettingsFromOptions(options)
+}
+
+// ConsulStorage keeps certificates, keys and locks in the Consul KV store so replicas of the ingress share them.
+//
+// Values are stored as is under the prefix with the time they were written in the flags of the KV pair.
+// Locks are Consul session locks under <prefix>/locks, released if the replica holding them stops
+// renewing its session so ACME orders aren't blocked by a replica which has gone away.
+type ConsulStorage struct {
+	// Prefix of the KV keys, defaults to caddy-tls
+	Prefix string `json:"prefix,omitempty"`
+
+	// Address of the Consul server, defaults to the ingress setting
+	Address string `json:"address,omitempty"`
+
+	// Access token for Consul, defaults to the ingress setting
+	Token string `json:"token,omitempty"`
+
+	settings consulSettings
+	client   *consul.Client
+	logger   *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (ConsulStorage) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.storage.consul",
+		New: func() caddy.Module { return new(ConsulStorage) },
+	}
+}
+
+func (s *ConsulStorage) Provision(ctx caddy.Context) error {
+	s.logger = ctx.Logger()
+
+	s.Prefix = strings.Trim(s.Prefix, "/")
+	if s.Prefix == "" {
+		s.Prefix = defaultStoragePrefix
+	}
+
+	// Caddy provisions the storage before the apps, the ingress app sets the default settings
+	if err := provisionIngressApp(ctx); err != nil {
+		return err
+	}
+
+	storageMutex.Lock()
+	settings := defaultStorage
+	storageMutex.Unlock()
+
+	if s.Address != "" {
+		settings.Address = s.Address
+	}
+	if s.Token != "" {
+		settings.Token = s.Token
+	}
+
+	client, err := sharedConsulClientFor(settings)
+	if err != nil {
+		return err
+	}
+	s.settings = settings
+	s.client = client
+
+	return nil
+}
+
+func (s *ConsulStorage) Cleanup() error {
+	if s.client != nil {
+		_, err := consulClients.Delete(s.settings)
+		return err
+	}
+	return nil
+}
+
+func (s *ConsulStorage) CertMagicStorage() (certmagic.Storage, error) {
+	return s, nil
+}
+
+// KV key of a storage key
+func (s *ConsulStorage) kvKey(key string) string {
+	return path.Join(s.Prefix, key)
+}
+
+// Storage key of a KV key
+func (s *ConsulStorage) storageKey(kvKey string) string {
+	return strings.TrimPrefix(kvKey, s.Prefix+"/")
+}
+
+func (s *ConsulStorage) Store(ctx context.Context, key string, value []byte) error {
+	pair := &consul.KVPair{
+		Key:   s.kvKey(key),
+		Value: value,
+		Flags: uint64(time.Now().Unix()),
+	}
+
+	if _, err := s.client.KV().Put(pair, (&consul.WriteOptions{}).WithContext(ctx)); err != nil {
+		return fmt.Errorf("failed to store %q: %w", key, err)
+	}
+	return nil
+}
+
+func (s *ConsulStorage) Load(ctx context.Context, key string) ([]byte, error) {
+	pair, _, err := s.client.KV().Get(s.kvKey(key), (&consul.QueryOptions{RequireConsistent: true}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load %q: %w", key, err)
+	}
+	if pair == nil {
+		return nil, fs.ErrNotExist
+	}
+	return pair.Value, nil
+}
+
+// Delete the key along with any keys under it
+func (s *ConsulStorage) Delete(ctx context.Context, key string) error {
+	kvKey := s.kvKey(key)
+	writeOptions := (&consul.WriteOptions{}).WithContext(ctx)
+
+	if _, err := s.client.KV().Delete(kvKey, writeOptions); err != nil {
+		return fmt.Errorf("failed to delete %q: %w", key, err)
+	}
+	if _, err := s.client.KV().DeleteTree(kvKey+"/", writeOptions); err != nil {
+		return fmt.Errorf("failed to delete %q: %w", key, err)
+	}
+	return nil
+}
+
+func (s *ConsulStorage) Exists(ctx context.Context, key string) bool {
+	_, err := s.Stat(ctx, key)
+	return err == nil
+}
+
+// List the keys under the path, only the keys directly under it unless recursive
+func (s *ConsulStorage) List(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	separator := "/"
+	if recursive {
+		separator = ""
+	}
+
+	kvKeys, _, err := s.client.KV().Keys(s.kvKey(prefix)+"/", separator, (&consul.QueryOptions{RequireConsistent: true}).WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %q: %w", prefix, err)
+	}
+	if len(kvKeys) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	keys := make([]string, 0, len(kvKeys))
+	for _, kvKey := range kvKeys {
+		// Keys ending in the separator are the directories directly under the path
+		keys = append(keys, s.storageKey(strings.TrimSuffix(kvKey, "/")))
+	}
+	return keys, nil
+}
+
+// Returns the size and time the key was written, or that it is a directory if there are keys under it
+func (s *ConsulStorage) Stat(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	queryOptions := (&consul.QueryOptions{RequireConsistent: true}).WithContext(ctx)
+
+	pair, _, err := s.client.KV().Get(s.kvKey(key), queryOptions)
+	if err != nil {
+		return certmagic.KeyInfo{}, fmt.Errorf("failed to stat %q: %w", key, err)
+	}
+	if pair != nil {
+		return certmagic.KeyInfo{
+			Key:        key,
+			Modified:   time.Unix(int64(pair.Flags), 0),
+			Size:       int64(len(pair.Value)),
+			IsTerminal: true,
+		}, nil
+	}
+
+	kvKeys, _, err := s.client.KV().Keys(s.kvKey(key)+"/", "/", queryOptions)
+	if err != nil {
+		return certmagic.KeyInfo{}, fmt.Errorf("failed to stat %q: %w", key, err)
+	}
+	if len(kvKeys) == 0 {
+		return certmagic.KeyInfo{}, fs.ErrNotExist
+	}
+	return certmagic.KeyInfo{Key: key, IsTerminal: false}, nil
+}
+
+// Acquire the named lock, blocking until it is released by the replica holding it or the context is done
+func (s *ConsulStorage) Lock(ctx context.Context, name string) error {
+	lockKey := s.kvKey(path.Join("locks", name))
+
+	lock, err := s.client.LockOpts(&consul.LockOptions{
+		Key:            lockKey,
+		SessionName:    "caddy-consul-ingress-storage",
+		SessionTTL:     storageLockTTL,
+		MonitorRetries: 3,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create lock %q: %w", name, err)
+	}
+
+	lostCh, err := lock.Lock(ctx.Done())
+	if err != nil {
+		return fmt.Errorf("failed to acquire lock %q: %w", name, err)
+	}
+	if lostCh == nil { // The context was done while waiting for the lock
+		return ctx.Err()
+	}
+
+	storageMutex.Lock()
+	storageLocks[lockKey] = lock
+	storageMutex.Unlock()
+
+	s.logger.Debug("Acquired storage lock", zap.String("lock", name))
+	return nil
+}
+
+// Release the named lock and delete its key
+func (s *ConsulStorage) Unlock(_ context.Context, name string) error {
+	lockKey := s.kvKey(path.Join("locks", name))
+
+	storageMutex.Lock()
+	lock, ok := storageLocks[lockKey]
+	delete(storageLocks, lockKey)
+	storageMutex.Unlock()
+
+	if !ok {
+		return fmt.Errorf("lock %q is not held", name)
+	}
+
+	if err := lock.Unlock(); err != nil {
+		return fmt.Errorf("failed to release lock %q: %w", name, err)
+	}
+
+	// Fails if another replica is waiting on the lock, which then reuses the key
+	_ = lock.Destroy()
+
+	s.logger.Debug("Released storage lock", zap.String("lock", name))
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	storage consul [<prefix>] {
+//	    prefix  <prefix>
+//	    address <address>
+//	    token   <token>
+//	}
+func (s *ConsulStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume storage module name
+
+	args := d.RemainingArgs()
+	if len(args) > 1 {
+		return d.ArgErr()
+	}
+	if len(args) > 0 {
+		s.Prefix = args[0]
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "prefix":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Prefix = d.Val()
+
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Address = d.Val()
+
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			s.Token = d.Val()
+
+		default:
+			return d.Errf("unrecognized consul storage option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner      = (*ConsulStorage)(nil)
+	_ caddy.CleanerUpper     = (*ConsulStorage)(nil)
+	_ caddy.StorageConverter = (*ConsulStorage)(nil)
+	_ certmagic.Storage      = (*ConsulStorage)(nil)
+	_ caddyfile.Unmarshaler  = (*ConsulStorage)(nil)
+)
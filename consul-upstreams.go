@@ -0,0 +1,279 @@
+package caddyconsulingress
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+	"github.com/fortix/caddy-consul-ingress/parser"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Connection settings used by upstream modules that don't set their own, the ingress app sets these when provisioned
+type upstreamDefaults struct {
+	Consul      consulSettings
+	PassingOnly bool
+	WaitTime    time.Duration
+}
+
+var (
+	upstreamMutex    sync.Mutex
+	defaultUpstreams = upstreamDefaults{PassingOnly: true, WaitTime: 30 * time.Second}
+
+	// Health watchers shared by all upstream modules, keyed by the connection settings and stopped once no config uses them
+	upstreamWatchers = caddy.NewUsagePool()
+)
+
+// Set the connection settings used by upstream modules which don't set their own from the ingress options
+func SetUpstreamDefaults(options *config.Options) {
+	upstreamMutex.Lock()
+	defer upstreamMutex.Unlock()
+
+	defaultUpstreams = upstreamDefaults{
+		Consul:      consulSettingsFromOptions(options),
+		PassingOnly: options.HealthPassingOnly,
+		WaitTime:    options.PollingInterval,
+	}
+}
+
+// Returns the health watcher shared by upstream modules with the same connection settings, each call must be matched by a release
+func sharedHealthWatcher(settings upstreamDefaults) (*HealthWatcher, error) {
+	watcher, _, err := upstreamWatchers.LoadOrNew(settings, func() (caddy.Destructor, error) {
+		consulClient, err := consul.NewClient(settings.Consul.config())
+		if err != nil {
+			return nil, err
+		}
+
+		// Instance changes are picked up by GetUpstreams so there's no need to regenerate the config
+		return NewHealthWatcher(caddy.Log().Named("consul-upstreams"), consulClient, settings.PassingOnly, settings.WaitTime, nil), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return watcher.(*HealthWatcher), nil
+}
+
+// ConsulUpstreams provides reverse proxy upstreams from the healthy instances of a Consul service.
+//
+// Instances are watched with blocking queries shared between all modules using the same service,
+// so changes to the instances take effect without reloading the config. When the service has no
+// healthy instances the instances in the first of the failover datacenters with any are used.
+type ConsulUpstreams struct {
+	// The name of the Consul service
+	Service string `json:"service,omitempty"`
+
+	// Datacenter of the service, defaults to the datacenter of the Consul agent
+	Datacenter string `json:"datacenter,omitempty"`
+
+	// Datacenters to use the instances of the service from in order when it has no healthy instances
+	Failover []string `json:"failover,omitempty"`
+
+	// Namespace of the service in Consul Enterprise, defaults to the namespace of the token
+	Namespace string `json:"namespace,omitempty"`
+
+	// Admin partition of the service in Consul Enterprise, defaults to the partition of the token
+	Partition string `json:"partition,omitempty"`
+
+	// Only use instances passing their health checks, defaults to the ingress setting
+	PassingOnly *bool `json:"passing_only,omitempty"`
+
+	// Address of the Consul server, defaults to the ingress setting
+	Address string `json:"address,omitempty"`
+
+	// Access token for Consul, defaults to the ingress setting
+	Token string `json:"token,omitempty"`
+
+	settings upstreamDefaults
+	services []parser.ServiceRef
+	ready    []<-chan struct{}
+	watcher  *HealthWatcher
+}
+
+// CaddyModule returns the Caddy module information.
+func (ConsulUpstreams) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.reverse_proxy.upstreams.consul",
+		New: func() caddy.Module { return new(ConsulUpstreams) },
+	}
+}
+
+func (u *ConsulUpstreams) Provision(ctx caddy.Context) error {
+	if u.Service == "" {
+		return fmt.Errorf("consul upstreams require a service")
+	}
+
+	// The HTTP app may be provisioned before the ingress app which sets the default settings
+	if err := provisionIngressApp(ctx); err != nil {
+		return err
+	}
+
+	upstreamMutex.Lock()
+	settings := defaultUpstreams
+	upstreamMutex.Unlock()
+
+	if u.Address != "" {
+		settings.Consul.Address = u.Address
+	}
+	if u.Token != "" {
+		settings.Consul.Token = u.Token
+	}
+	if u.PassingOnly != nil {
+		settings.PassingOnly = *u.PassingOnly
+	}
+
+	watcher, err := sharedHealthWatcher(settings)
+	if err != nil {
+		return err
+	}
+	u.settings = settings
+
+	service := parser.ServiceRef{
+		Name:  u.Service,
+		Scope: parser.Scope{Datacenter: u.Datacenter, Namespace: u.Namespace, Partition: u.Partition},
+	}
+	u.services = service.WithFailover(u.Failover)
+	u.watcher = watcher
+
+	// Blocking until each service is fetched would hold up loading the config, requests wait for it instead
+	u.ready = make([]<-chan struct{}, 0, len(u.services))
+	for _, service := range u.services {
+		u.ready = append(u.ready, u.watcher.Acquire(service))
+	}
+
+	return nil
+}
+
+func (u *ConsulUpstreams) Cleanup() error {
+	if u.watcher != nil {
+		for _, service := range u.services {
+			u.watcher.Release(service)
+		}
+		_, err := upstreamWatchers.Delete(u.settings)
+		return err
+	}
+	return nil
+}
+
+func (u *ConsulUpstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
+	var instances []string
+	for i, service := range u.services {
+		// Until the first fetch of the service has completed its instances aren't known
+		select {
+		case <-u.ready[i]:
+		case <-r.Context().Done():
+			return nil, r.Context().Err()
+		}
+
+		if instances = u.watcher.ServiceInstances(service); len(instances) > 0 {
+			break
+		}
+	}
+
+	upstreams := make([]*reverseproxy.Upstream, 0, len(instances))
+	for _, instance := range instances {
+		upstreams = append(upstreams, &reverseproxy.Upstream{Dial: instance})
+	}
+
+	return upstreams, nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	dynamic consul [<service>] {
+//	    service      <service>
+//	    datacenter   <datacenter>
+//	    failover     <datacenters...>
+//	    namespace    <namespace>
+//	    partition    <partition>
+//	    passing_only <true|false>
+//	    address      <address>
+//	    token        <token>
+//	}
+func (u *ConsulUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume upstream source name
+
+	args := d.RemainingArgs()
+	if len(args) > 1 {
+		return d.ArgErr()
+	}
+	if len(args) > 0 {
+		u.Service = args[0]
+	}
+
+	for d.NextBlock(0) {
+		switch d.Val() {
+		case "service":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Service = d.Val()
+
+		case "datacenter":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Datacenter = d.Val()
+
+		case "failover":
+			u.Failover = append(u.Failover, d.RemainingArgs()...)
+			if len(u.Failover) == 0 {
+				return d.ArgErr()
+			}
+
+		case "namespace":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Namespace = d.Val()
+
+		case "partition":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Partition = d.Val()
+
+		case "passing_only":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			passingOnly, err := strconv.ParseBool(d.Val())
+			if err != nil {
+				return d.Errf("invalid passing_only value '%s': %v", d.Val(), err)
+			}
+			u.PassingOnly = &passingOnly
+
+		case "address":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Address = d.Val()
+
+		case "token":
+			if !d.NextArg() {
+				return d.ArgErr()
+			}
+			u.Token = d.Val()
+
+		default:
+			return d.Errf("unrecognized consul option '%s'", d.Val())
+		}
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*ConsulUpstreams)(nil)
+	_ caddy.CleanerUpper          = (*ConsulUpstreams)(nil)
+	_ reverseproxy.UpstreamSource = (*ConsulUpstreams)(nil)
+	_ caddyfile.Unmarshaler       = (*ConsulUpstreams)(nil)
+)
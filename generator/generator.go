@@ -3,12 +3,14 @@ package generator
 import (
 	"bytes"
 	"embed"
+	"fmt"
 	"html/template"
 	"path"
 
 	"github.com/fortix/caddy-consul-ingress/config"
 	"github.com/fortix/caddy-consul-ingress/parser"
 
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"go.uber.org/zap"
 )
 
@@ -30,67 +32,31 @@ func NewGenerator(log *zap.Logger, options *config.Options) *CaddyfileGenerator
 	}
 }
 
-func (generator *CaddyfileGenerator) Generate(serviceDefs *parser.Services, kvServiceDefs *parser.Services) string {
+// Generate the Caddyfile from the services, instances holds the healthy address:port of each service when using health upstreams.
+// Returns the Caddyfile and the services found claiming the same URL.
+func (generator *CaddyfileGenerator) Generate(serviceDefs *parser.Services, kvServiceDefs *parser.Services, instances map[string][]string) (string, []parser.Conflict, error) {
 
-	// Combine the service definitions and the KV service definitions into a single slice of service definitions
-	var allServiceDefs []*parser.ServiceDef
-	if serviceDefs != nil {
-		allServiceDefs = append(allServiceDefs, serviceDefs.Services...)
-	}
-	if kvServiceDefs != nil {
-		allServiceDefs = append(allServiceDefs, kvServiceDefs.Services...)
+	sites := mergeServices(generator.options, serviceDefs, kvServiceDefs, instances)
+
+	caddyfile, err := generator.render(sites)
+	if err != nil {
+		return "", nil, err
 	}
 
-	// Create a map of wildcard domains to service definitions, merge from serviceDefs and kvServiceDefs if they have the wildcard domain
-	wildcardGroups := make(map[string]*parser.ServiceGroup)
-	for _, wildcardDomain := range generator.options.WildcardDomains {
-		wc := make([]*parser.ServiceDef, 0)
-		to := ""
-		upstream := ""
-		serviceName := ""
-		useHttps := false
-		skipTlsVerify := false
-
-		if serviceDefs != nil {
-			if _, ok := serviceDefs.ServiceGroups[wildcardDomain]; ok {
-				wc = append(wc, serviceDefs.ServiceGroups[wildcardDomain].Services...)
-
-				if serviceDefs.ServiceGroups[wildcardDomain].Upstream != "" {
-					to = serviceDefs.ServiceGroups[wildcardDomain].To
-					upstream = serviceDefs.ServiceGroups[wildcardDomain].Upstream
-					serviceName = serviceDefs.ServiceGroups[wildcardDomain].ServiceName
-					useHttps = serviceDefs.ServiceGroups[wildcardDomain].UseHttps
-					skipTlsVerify = serviceDefs.ServiceGroups[wildcardDomain].SkipTlsVerify
-				}
-			}
-		}
-
-		if kvServiceDefs != nil {
-			if _, ok := kvServiceDefs.ServiceGroups[wildcardDomain]; ok {
-				wc = append(wc, kvServiceDefs.ServiceGroups[wildcardDomain].Services...)
-
-				if kvServiceDefs.ServiceGroups[wildcardDomain].Upstream != "" {
-					to = kvServiceDefs.ServiceGroups[wildcardDomain].To
-					upstream = kvServiceDefs.ServiceGroups[wildcardDomain].Upstream
-					serviceName = kvServiceDefs.ServiceGroups[wildcardDomain].ServiceName
-					useHttps = kvServiceDefs.ServiceGroups[wildcardDomain].UseHttps
-					skipTlsVerify = kvServiceDefs.ServiceGroups[wildcardDomain].SkipTlsVerify
-				}
-			}
-		}
-
-		if len(wc) > 0 || upstream != "" {
-			wildcardGroups[wildcardDomain] = parser.NewServiceGroup()
-			wildcardGroups[wildcardDomain].To = to
-			wildcardGroups[wildcardDomain].Upstream = upstream
-			wildcardGroups[wildcardDomain].ServiceName = serviceName
-			wildcardGroups[wildcardDomain].UseHttps = useHttps
-			wildcardGroups[wildcardDomain].SkipTlsVerify = skipTlsVerify
-			wildcardGroups[wildcardDomain].Services = wc
-		}
+	if generator.options.Verbose {
+		generator.log.Info(caddyfile)
 	}
 
-	var caddyfile = ""
+	return caddyfile, sites.conflicts, nil
+}
+
+// Check the template parses and executes without any services, so template errors are caught at startup
+func (generator *CaddyfileGenerator) Validate() error {
+	_, err := generator.render(mergeServices(generator.options, nil, nil, nil))
+	return err
+}
+
+func (generator *CaddyfileGenerator) render(sites *siteData) (string, error) {
 	var tmpl *template.Template
 	var err error
 
@@ -102,25 +68,21 @@ func (generator *CaddyfileGenerator) Generate(serviceDefs *parser.Services, kvSe
 	}
 
 	if err != nil {
-		generator.log.Fatal("Failed to parse template", zap.Error(err))
+		return "", fmt.Errorf("failed to parse template: %w", err)
 	}
 
 	var tmplData = map[string]interface{}{
-		"services":         allServiceDefs,
-		"wildcardServices": wildcardGroups,
+		"services":         sites.services,
+		"hosts":            sites.hostGroups,
+		"wildcardServices": sites.wildcardGroups,
 	}
 
 	var tmplBytes bytes.Buffer
 	err = tmpl.Execute(&tmplBytes, tmplData)
 	if err != nil {
-		generator.log.Fatal("Failed to execute template", zap.Error(err))
-	}
-
-	caddyfile = tmplBytes.String()
-
-	if generator.options.Verbose {
-		generator.log.Info(caddyfile)
+		return "", fmt.Errorf("failed to execute template: %w", err)
 	}
 
-	return caddyfile
+	// Blocks defined once in the template are nested at different depths, formatting fixes their indentation so the adapter doesn't warn
+	return string(caddyfile.Format(tmplBytes.Bytes())), nil
 }
@@ -0,0 +1,459 @@
+package generator
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+	"github.com/fortix/caddy-consul-ingress/parser"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/headers"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/rewrite"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"go.uber.org/zap"
+)
+
+// Builds the Caddy JSON config directly from the services, the equivalent of the default template without the Caddyfile adapter
+type JSONGenerator struct {
+	log     *zap.Logger
+	options *config.Options
+}
+
+func NewJSONGenerator(log *zap.Logger, options *config.Options) *JSONGenerator {
+	return &JSONGenerator{
+		log:     log,
+		options: options,
+	}
+}
+
+// Generate the JSON config from the services, instances holds the healthy address:port of each service when using health upstreams.
+// Returns the config and the services found claiming the same URL.
+func (generator *JSONGenerator) Generate(serviceDefs *parser.Services, kvServiceDefs *parser.Services, instances map[string][]string) ([]byte, []parser.Conflict, error) {
+	sites := mergeServices(generator.options, serviceDefs, kvServiceDefs, instances)
+
+	// Exact hosts first so they take precedence over the wildcard domains, sites with tls=off are served by a plain HTTP server
+	var routes, plainRoutes caddyhttp.RouteList
+	var hosts, plainHosts []string
+	policies := newTLSPolicies()
+	for _, hostGroup := range sites.hostGroups {
+		siteTLS := hostGroup.SiteTLS()
+		if siteTLS != nil && siteTLS.Mode == parser.TLSModeOff {
+			plainRoutes = append(plainRoutes, generator.hostRoute(hostGroup))
+			plainHosts = append(plainHosts, hostGroup.Host)
+			continue
+		}
+
+		routes = append(routes, generator.hostRoute(hostGroup))
+		hosts = append(hosts, hostGroup.Host)
+		policies.add(hostname(hostGroup.Host), siteTLS)
+	}
+
+	wildcardDomains := make([]string, 0, len(sites.wildcardGroups))
+	for wildcardDomain := range sites.wildcardGroups {
+		wildcardDomains = append(wildcardDomains, wildcardDomain)
+	}
+	sort.Strings(wildcardDomains)
+
+	for _, wildcardDomain := range wildcardDomains {
+		serviceGroup := sites.wildcardGroups[wildcardDomain]
+		siteHosts := make([]string, 0)
+		for _, def := range serviceGroup.Services {
+			siteHosts = append(siteHosts, def.SrvUrls...)
+		}
+
+		siteTLS := serviceGroup.SiteTLS()
+		if siteTLS != nil && siteTLS.Mode == parser.TLSModeOff {
+			plainRoutes = append(plainRoutes, generator.wildcardRoute(wildcardDomain, serviceGroup))
+			plainHosts = append(plainHosts, siteHosts...)
+			continue
+		}
+
+		routes = append(routes, generator.wildcardRoute(wildcardDomain, serviceGroup))
+		hosts = append(hosts, siteHosts...)
+		policies.add(hostname(wildcardDomain), siteTLS)
+	}
+
+	servers := make(map[string]*caddyhttp.Server)
+	var plainListen []string
+	if len(plainRoutes) > 0 {
+		// Automatic HTTPS would otherwise serve TLS on any port other than the HTTP port
+		plainListen = listenAddresses(plainHosts, "80", nil)
+		servers["srv1"] = &caddyhttp.Server{
+			Listen:    plainListen,
+			Routes:    plainRoutes,
+			AutoHTTPS: &caddyhttp.AutoHTTPSConfig{Disabled: true},
+		}
+	}
+	servers["srv0"] = &caddyhttp.Server{
+		Listen: listenAddresses(hosts, "443", plainListen),
+		Routes: routes,
+	}
+
+	httpApp := caddyhttp.App{
+		GracePeriod: caddy.Duration(3 * time.Second),
+		Servers:     servers,
+	}
+
+	apps := caddy.ModuleMap{
+		"http": caddyconfig.JSON(httpApp, nil),
+	}
+	if len(policies.policies) > 0 {
+		apps["tls"] = caddyconfig.JSON(caddytls.TLS{
+			Automation: &caddytls.AutomationConfig{Policies: policies.policies},
+		}, nil)
+	}
+
+	// The admin endpoint isn't set so the one of the loaded config is kept, Caddy's default otherwise
+	cfg := caddy.Config{
+		Logging: &caddy.Logging{
+			Logs: map[string]*caddy.CustomLog{
+				"default": {
+					BaseLog: caddy.BaseLog{
+						WriterRaw:  caddyconfig.JSONModuleObject(struct{}{}, "output", "stdout", nil),
+						EncoderRaw: caddyconfig.JSONModuleObject(struct{}{}, "format", "console", nil),
+						Level:      "WARN",
+					},
+				},
+			},
+		},
+		AppsRaw: apps,
+	}
+
+	cfgJSON, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if generator.options.Verbose {
+		generator.log.Info(string(cfgJSON))
+	}
+
+	return cfgJSON, sites.conflicts, nil
+}
+
+// Route for a host, services are routed by path with the longest prefix first
+func (generator *JSONGenerator) hostRoute(hostGroup *parser.HostGroup) caddyhttp.Route {
+	var serviceRoutes caddyhttp.RouteList
+	for _, def := range hostGroup.Services {
+		serviceRoutes = append(serviceRoutes, caddyhttp.Route{
+			MatcherSetsRaw: pathMatcher(def.Path),
+			HandlersRaw:    generator.serviceHandlers(def.To, def.Upstream, def.Sources, def.Scope, def.ServiceOptions),
+			Terminal:       true,
+		})
+	}
+
+	if !hostGroup.HasRoot() {
+		serviceRoutes = append(serviceRoutes, abortRoute())
+	}
+
+	return siteRoute([]string{hostGroup.Host}, serviceRoutes)
+}
+
+// Route for a wildcard domain, services are matched by host and path before falling back to the default handler
+func (generator *JSONGenerator) wildcardRoute(wildcardDomain string, serviceGroup *parser.ServiceGroup) caddyhttp.Route {
+	var serviceRoutes caddyhttp.RouteList
+	for _, def := range serviceGroup.Services {
+		matcherSet := caddy.ModuleMap{
+			"host": hostMatcher(def.SrvUrls),
+		}
+		if def.Path != "" {
+			matcherSet["path"] = caddyconfig.JSON(caddyhttp.MatchPath{def.Path, def.Path + "/*"}, nil)
+		}
+
+		serviceRoutes = append(serviceRoutes, caddyhttp.Route{
+			MatcherSetsRaw: caddyhttp.RawMatcherSets{matcherSet},
+			HandlersRaw:    generator.serviceHandlers(def.To, def.Upstream, def.Sources, def.Scope, def.ServiceOptions),
+			Terminal:       true,
+		})
+	}
+
+	if serviceGroup.Upstream == "" {
+		serviceRoutes = append(serviceRoutes, abortRoute())
+	} else {
+		serviceRoutes = append(serviceRoutes, caddyhttp.Route{
+			HandlersRaw: generator.serviceHandlers(serviceGroup.To, serviceGroup.Upstream, serviceGroup.Sources, serviceGroup.Scope, serviceGroup.ServiceOptions),
+			Terminal:    true,
+		})
+	}
+
+	return siteRoute([]string{wildcardDomain}, serviceRoutes)
+}
+
+// Handlers to rewrite the request for a service and proxy it to the upstreams, scope is the scope of a Consul service
+// and sources are the services combined by the merge conflict policy
+func (generator *JSONGenerator) serviceHandlers(to string, upstream string, sources []*parser.ServiceDef, scope parser.Scope, options parser.ServiceOptions) []json.RawMessage {
+	var handlers []json.RawMessage
+
+	if options.StripPrefix != "" {
+		handlers = append(handlers, caddyconfig.JSONModuleObject(rewrite.Rewrite{StripPathPrefix: options.StripPrefix}, "handler", "rewrite", nil))
+	}
+	if options.Rewrite != "" {
+		handlers = append(handlers, caddyconfig.JSONModuleObject(rewrite.Rewrite{URI: options.Rewrite + "{http.request.uri}"}, "handler", "rewrite", nil))
+	}
+
+	return append(handlers, caddyconfig.JSONModuleObject(generator.reverseProxy(to, upstream, sources, scope, options), "handler", "reverse_proxy", nil))
+}
+
+// The reverse proxy handler with the same settings as the reverseProxyConfig snippet of the default template
+func (generator *JSONGenerator) reverseProxy(to string, upstream string, sources []*parser.ServiceDef, scope parser.Scope, options parser.ServiceOptions) *reverseproxy.Handler {
+	transport := reverseproxy.HTTPTransport{
+		Versions:        []string{"2"},
+		ReadBufferSize:  32 * 1024,
+		WriteBufferSize: 32 * 1024,
+	}
+
+	handler := &reverseproxy.Handler{
+		LoadBalancing: &reverseproxy.LoadBalancing{
+			SelectionPolicyRaw: caddyconfig.JSONModuleObject(reverseproxy.LeastConnSelection{}, "policy", "least_conn", nil),
+			TryDuration:        caddy.Duration(2 * time.Second),
+			TryInterval:        caddy.Duration(150 * time.Millisecond),
+		},
+		HealthChecks: &reverseproxy.HealthChecks{
+			Passive: &reverseproxy.PassiveHealthChecks{
+				FailDuration:    caddy.Duration(4 * time.Second),
+				UnhealthyStatus: []int{5},
+			},
+		},
+		Headers: &headers.Handler{
+			Request: &headers.HeaderOps{
+				Add: http.Header{
+					"X_forwarded_port":  []string{"443"},
+					"X_forwarded_proto": []string{"https"},
+				},
+				Set: http.Header{
+					"X-Real-Ip": []string{"{http.request.remote.host}"},
+				},
+			},
+		},
+	}
+
+	switch to {
+	case "dynamic srv", "dynamic consul":
+		handler.DynamicUpstreamsRaw = upstreamSource(to, upstream, scope, options.Failover)
+
+	case "dynamic multi":
+		var multi reverseproxy.MultiUpstreams
+		for _, source := range sources {
+			multi.SourcesRaw = append(multi.SourcesRaw, upstreamSource(source.To, source.Upstream, source.Scope, source.Failover))
+		}
+		handler.DynamicUpstreamsRaw = caddyconfig.JSONModuleObject(multi, "source", "multi", nil)
+
+	default:
+		for _, address := range strings.Fields(upstream) {
+			dial, useTls := parseUpstreamAddress(address)
+			if useTls {
+				options.UseHttps = true
+			}
+			handler.Upstreams = append(handler.Upstreams, &reverseproxy.Upstream{Dial: dial})
+		}
+	}
+
+	if options.UseHttps {
+		transport.TLS = &reverseproxy.TLSConfig{
+			InsecureSkipVerify: options.SkipTlsVerify,
+		}
+	}
+
+	handler.TransportRaw = caddyconfig.JSONModuleObject(transport, "protocol", "http", nil)
+
+	return handler
+}
+
+// Dynamic upstream source for a service resolved through Consul DNS or the consul upstreams module
+func upstreamSource(to string, upstream string, scope parser.Scope, failover []string) json.RawMessage {
+	if to == "dynamic srv" {
+		return caddyconfig.JSONModuleObject(reverseproxy.SRVUpstreams{
+			Name:        upstream,
+			Refresh:     caddy.Duration(5 * time.Second),
+			DialTimeout: caddy.Duration(time.Second),
+		}, "source", "srv", nil)
+	}
+
+	source := map[string]any{
+		"source":  "consul",
+		"service": upstream,
+	}
+	if scope.Datacenter != "" {
+		source["datacenter"] = scope.Datacenter
+	}
+	if scope.Namespace != "" {
+		source["namespace"] = scope.Namespace
+	}
+	if scope.Partition != "" {
+		source["partition"] = scope.Partition
+	}
+	if len(failover) > 0 {
+		source["failover"] = failover
+	}
+	return caddyconfig.JSON(source, nil)
+}
+
+// Returns the dial address for an upstream and if it uses TLS, in the same way as the Caddyfile to directive
+func parseUpstreamAddress(address string) (string, bool) {
+	if !strings.Contains(address, "://") {
+		return address, false
+	}
+
+	u, err := url.Parse(address)
+	if err != nil {
+		return address, false
+	}
+
+	port := u.Port()
+	if port == "" {
+		if u.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+
+	return net.JoinHostPort(u.Hostname(), port), u.Scheme == "https"
+}
+
+// Listen on the default port and any ports given in the hosts as a Caddyfile site address would, except those in exclude
+func listenAddresses(hosts []string, defaultPort string, exclude []string) []string {
+	ports := map[string]bool{defaultPort: true}
+	for _, host := range hosts {
+		if _, port, err := net.SplitHostPort(host); err == nil {
+			ports[port] = true
+		}
+	}
+
+	excluded := make(map[string]bool, len(exclude))
+	for _, address := range exclude {
+		excluded[address] = true
+	}
+
+	listen := make([]string, 0, len(ports))
+	for port := range ports {
+		if !excluded[":"+port] {
+			listen = append(listen, ":"+port)
+		}
+	}
+	sort.Strings(listen)
+
+	return listen
+}
+
+// Automation policies for the sites setting the tls option, the first site for a subject sets its policy
+type tlsPolicies struct {
+	policies []*caddytls.AutomationPolicy
+	subjects map[string]bool
+}
+
+func newTLSPolicies() *tlsPolicies {
+	return &tlsPolicies{
+		subjects: make(map[string]bool),
+	}
+}
+
+// Add the policy the tls option gives the subject, the equivalent of the tls block of the default template
+func (p *tlsPolicies) add(subject string, options *parser.TLSOptions) {
+	if options == nil || p.subjects[subject] {
+		return
+	}
+
+	policy := &caddytls.AutomationPolicy{SubjectsRaw: []string{subject}}
+	switch options.Mode {
+	case parser.TLSModeInternal:
+		policy.IssuersRaw = []json.RawMessage{
+			caddyconfig.JSONModuleObject(caddytls.InternalIssuer{}, "module", "internal", nil),
+		}
+
+	case parser.TLSModeDNS:
+		policy.IssuersRaw = []json.RawMessage{
+			caddyconfig.JSONModuleObject(caddytls.ACMEIssuer{
+				Challenges: &caddytls.ChallengesConfig{
+					DNS: &caddytls.DNSChallengeConfig{
+						ProviderRaw: caddyconfig.JSON(map[string]string{"name": options.Provider}, nil),
+					},
+				},
+			}, "module", "acme", nil),
+		}
+
+	case parser.TLSModeCert:
+		policy.ManagersRaw = []json.RawMessage{
+			caddyconfig.JSON(map[string]string{"via": "consul", "key": options.CertKey}, nil),
+		}
+
+	default:
+		return
+	}
+
+	p.policies = append(p.policies, policy)
+	p.subjects[subject] = true
+}
+
+// The host without any port
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// Host matcher for the hosts without any port, the port is matched by the listener
+func hostMatcher(hosts []string) json.RawMessage {
+	matchHosts := make(caddyhttp.MatchHost, 0, len(hosts))
+	for _, host := range hosts {
+		matchHosts = append(matchHosts, hostname(host))
+	}
+
+	return caddyconfig.JSON(matchHosts, nil)
+}
+
+// Terminal route matching the hosts, with the encoding and service routes in a subroute
+func siteRoute(hosts []string, serviceRoutes caddyhttp.RouteList) caddyhttp.Route {
+	encode := caddyconfig.JSON(map[string]any{
+		"handler": "encode",
+		"encodings": map[string]any{
+			"zstd": struct{}{},
+			"gzip": struct{}{},
+		},
+		"prefer": []string{"zstd", "gzip"},
+	}, nil)
+
+	routes := caddyhttp.RouteList{{HandlersRaw: []json.RawMessage{encode}}}
+	routes = append(routes, serviceRoutes...)
+
+	return caddyhttp.Route{
+		MatcherSetsRaw: caddyhttp.RawMatcherSets{
+			caddy.ModuleMap{"host": hostMatcher(hosts)},
+		},
+		HandlersRaw: []json.RawMessage{
+			caddyconfig.JSONModuleObject(caddyhttp.Subroute{Routes: routes}, "handler", "subroute", nil),
+		},
+		Terminal: true,
+	}
+}
+
+// Matcher for a path prefix, nil to match everything
+func pathMatcher(path string) caddyhttp.RawMatcherSets {
+	if path == "" {
+		return nil
+	}
+
+	return caddyhttp.RawMatcherSets{
+		caddy.ModuleMap{"path": caddyconfig.JSON(caddyhttp.MatchPath{path, path + "/*"}, nil)},
+	}
+}
+
+// Route aborting any request which reaches it
+func abortRoute() caddyhttp.Route {
+	return caddyhttp.Route{
+		HandlersRaw: []json.RawMessage{
+			caddyconfig.JSONModuleObject(caddyhttp.StaticResponse{Abort: true}, "handler", "static_response", nil),
+		},
+		Terminal: true,
+	}
+}
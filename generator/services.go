@@ -0,0 +1,270 @@
+package generator
+
+import (
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+	"github.com/fortix/caddy-consul-ingress/parser"
+)
+
+// Services from the catalog and KV merged together ready to generate a config from
+type siteData struct {
+	services       []*parser.ServiceDef
+	hostGroups     []*parser.HostGroup
+	wildcardGroups map[string]*parser.ServiceGroup
+	conflicts      []parser.Conflict
+}
+
+// Merge the services from the catalog and KV, group them by host and resolve their upstreams and any services claiming the same URL,
+// instances holds the healthy address:port of each service when using health upstreams
+func mergeServices(options *config.Options, serviceDefs *parser.Services, kvServiceDefs *parser.Services, instances map[string][]string) *siteData {
+	var conflicts []parser.Conflict
+
+	// Combine the service definitions and the KV service definitions into a single slice of service definitions
+	fromKV := make(map[*parser.ServiceDef]bool)
+	var allServiceDefs []*parser.ServiceDef
+	if serviceDefs != nil {
+		allServiceDefs = append(allServiceDefs, resolveUpstreams(options, serviceDefs.Services, instances)...)
+		conflicts = append(conflicts, serviceDefs.Conflicts...)
+	}
+	if kvServiceDefs != nil {
+		for _, def := range resolveUpstreams(options, kvServiceDefs.Services, instances) {
+			fromKV[def] = true
+			allServiceDefs = append(allServiceDefs, def)
+		}
+		conflicts = append(conflicts, kvServiceDefs.Conflicts...)
+	}
+
+	allServiceDefs, hostConflicts := resolveConflicts(options, allServiceDefs, fromKV)
+	conflicts = append(conflicts, hostConflicts...)
+
+	// Create a map of wildcard domains to service definitions, merge from serviceDefs and kvServiceDefs if they have the wildcard domain
+	wildcardGroups := make(map[string]*parser.ServiceGroup)
+	for _, wildcardDomain := range options.WildcardDomains {
+		wc := make([]*parser.ServiceDef, 0)
+		var defaults []parser.Claim
+
+		addGroup := func(services *parser.Services, kv bool) {
+			if services == nil {
+				return
+			}
+
+			serviceGroup, ok := services.ServiceGroups[wildcardDomain]
+			if !ok {
+				return
+			}
+
+			for _, def := range resolveUpstreams(options, serviceGroup.Services, instances) {
+				fromKV[def] = kv
+				wc = append(wc, def)
+			}
+
+			if serviceGroup.Upstream != "" {
+				def := &parser.ServiceDef{
+					To:             serviceGroup.To,
+					Upstream:       serviceGroup.Upstream,
+					ServiceName:    serviceGroup.ServiceName,
+					Scope:          serviceGroup.Scope,
+					ServiceOptions: serviceGroup.ServiceOptions,
+					Sources:        serviceGroup.Sources,
+				}
+				defaults = append(defaults, parser.Claim{Def: resolveDef(options, def, instances), FromKV: kv})
+			}
+		}
+		addGroup(serviceDefs, false)
+		addGroup(kvServiceDefs, true)
+
+		if len(wc) > 0 || len(defaults) > 0 {
+			wildcardGroups[wildcardDomain] = parser.NewServiceGroup()
+			if len(defaults) > 0 {
+				def, conflict := parser.ResolveConflict(options.ConflictPolicy, wildcardDomain, "", defaults)
+				if conflict != nil {
+					conflicts = append(conflicts, *conflict)
+				}
+				wildcardGroups[wildcardDomain].SetDefault(def)
+			}
+
+			var wildcardConflicts []parser.Conflict
+			wildcardGroups[wildcardDomain].Services, wildcardConflicts = resolveConflicts(options, wc, fromKV)
+			conflicts = append(conflicts, wildcardConflicts...)
+
+			// Merged services need sorting so the longest path prefixes are matched first
+			parser.SortServiceDefs(wildcardGroups[wildcardDomain].Services)
+		}
+	}
+
+	// Group the service definitions by site so services sharing a host are routed by path
+	hostMap := make(map[string]*parser.HostGroup)
+	for _, def := range allServiceDefs {
+		for _, host := range def.SrvUrls {
+			address := parser.SiteAddress(host)
+			if _, ok := hostMap[address]; !ok {
+				hostMap[address] = parser.NewHostGroup(address)
+			}
+			if !slices.Contains(hostMap[address].Services, def) {
+				hostMap[address].Services = append(hostMap[address].Services, def)
+			}
+		}
+	}
+
+	hostGroups := make([]*parser.HostGroup, 0, len(hostMap))
+	for _, hostGroup := range hostMap {
+		parser.SortServiceDefs(hostGroup.Services)
+		hostGroups = append(hostGroups, hostGroup)
+	}
+
+	sort.Slice(hostGroups, func(i, j int) bool {
+		return hostGroups[i].Host < hostGroups[j].Host
+	})
+
+	parser.SortConflicts(conflicts)
+
+	return &siteData{
+		services:       allServiceDefs,
+		hostGroups:     hostGroups,
+		wildcardGroups: wildcardGroups,
+		conflicts:      conflicts,
+	}
+}
+
+// Resolve the services claiming the same host and path with the conflict policy, fromKV is true for the KV routes.
+// Services losing a URL are copied without it and dropped if they have no URLs left, services merged by the policy are added.
+func resolveConflicts(options *config.Options, defs []*parser.ServiceDef, fromKV map[*parser.ServiceDef]bool) ([]*parser.ServiceDef, []parser.Conflict) {
+	type claimKey struct {
+		address string
+		path    string
+	}
+
+	claims := make(map[claimKey][]parser.Claim)
+	var keys []claimKey
+	for _, def := range defs {
+		// A service listing the same site more than once, e.g. example.com and Example.com:443, claims it once
+		claimed := make(map[claimKey]bool)
+		for _, host := range def.SrvUrls {
+			key := claimKey{parser.SiteAddress(host), def.Path}
+			if claimed[key] {
+				continue
+			}
+			claimed[key] = true
+
+			if _, ok := claims[key]; !ok {
+				keys = append(keys, key)
+			}
+			claims[key] = append(claims[key], parser.Claim{Def: def, FromKV: fromKV[def]})
+		}
+	}
+
+	var conflicts []parser.Conflict
+	var merged []*parser.ServiceDef
+	lost := make(map[*parser.ServiceDef]map[string]bool)
+	for _, key := range keys {
+		if len(claims[key]) < 2 {
+			continue
+		}
+
+		winner, conflict := parser.ResolveConflict(options.ConflictPolicy, key.address, key.path, claims[key])
+		if conflict != nil {
+			conflicts = append(conflicts, *conflict)
+		}
+
+		for _, claim := range claims[key] {
+			if claim.Def != winner {
+				if lost[claim.Def] == nil {
+					lost[claim.Def] = make(map[string]bool)
+				}
+				lost[claim.Def][key.address] = true
+			}
+		}
+
+		// A service merged by the policy is new and has no URLs yet
+		if len(winner.SrvUrls) == 0 {
+			winner.SrvUrls = []string{key.address}
+			merged = append(merged, winner)
+		}
+	}
+
+	if len(lost) == 0 {
+		return defs, conflicts
+	}
+
+	resolved := make([]*parser.ServiceDef, 0, len(defs)+len(merged))
+	for _, def := range defs {
+		if lost[def] == nil {
+			resolved = append(resolved, def)
+			continue
+		}
+
+		// Copy so the parsed definition is left untouched for the next generation
+		resolvedDef := *def
+		resolvedDef.SrvUrls = nil
+		for _, host := range def.SrvUrls {
+			if !lost[def][parser.SiteAddress(host)] {
+				resolvedDef.SrvUrls = append(resolvedDef.SrvUrls, host)
+			}
+		}
+		if len(resolvedDef.SrvUrls) > 0 {
+			resolved = append(resolved, &resolvedDef)
+		}
+	}
+
+	return append(resolved, merged...), conflicts
+}
+
+// Replace the SRV upstreams of Consul services according to the upstream mode
+func resolveUpstreams(options *config.Options, defs []*parser.ServiceDef, instances map[string][]string) []*parser.ServiceDef {
+	if options.UpstreamMode != config.UpstreamModeHealth && options.UpstreamMode != config.UpstreamModeConsul {
+		return defs
+	}
+
+	resolved := make([]*parser.ServiceDef, 0, len(defs))
+	for _, def := range defs {
+		resolved = append(resolved, resolveDef(options, def, instances))
+	}
+
+	return resolved
+}
+
+// Resolve the upstreams of a definition according to the upstream mode, the services combined by the merge conflict policy
+// are resolved one by one and merged again
+func resolveDef(options *config.Options, def *parser.ServiceDef, instances map[string][]string) *parser.ServiceDef {
+	if def.ServiceName == "" {
+		return def
+	}
+
+	// Copy so the parsed definition is left untouched for the next generation
+	resolvedDef := *def
+	if len(def.Sources) == 0 {
+		resolvedDef.To, resolvedDef.Upstream = resolveUpstream(options, def, instances)
+		return &resolvedDef
+	}
+
+	claims := make([]parser.Claim, 0, len(def.Sources))
+	for _, source := range def.Sources {
+		claims = append(claims, parser.Claim{Def: resolveDef(options, source, instances)})
+	}
+	merged, _ := parser.ResolveConflict(config.ConflictPolicyMerge, "", "", claims)
+	resolvedDef.To, resolvedDef.Upstream, resolvedDef.Sources = merged.To, merged.Upstream, merged.Sources
+	return &resolvedDef
+}
+
+// Returns the to and upstream for the Consul service of a definition according to the upstream mode, the instances are keyed by the qualified service name.
+// With health upstreams the instances of the first failover datacenter with any are used when the service has none.
+func resolveUpstream(options *config.Options, def *parser.ServiceDef, instances map[string][]string) (string, string) {
+	switch options.UpstreamMode {
+	case config.UpstreamModeHealth:
+		var upstreams []string
+		for _, service := range def.Service().WithFailover(def.Failover) {
+			if upstreams = instances[service.String()]; len(upstreams) > 0 {
+				break
+			}
+		}
+		return "to", strings.Join(upstreams, " ")
+	case config.UpstreamModeConsul:
+		// The scope and failover datacenters of the service are passed to the upstreams module separately
+		return "dynamic consul", def.ServiceName
+	default:
+		return def.To, def.Upstream
+	}
+}
@@ -0,0 +1,103 @@
+package generator
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+	"github.com/fortix/caddy-consul-ingress/parser"
+)
+
+func srvDef(name string, path string, hosts ...string) *parser.ServiceDef {
+	ref := parser.ServiceRef{Name: name}
+	return &parser.ServiceDef{
+		To:          "dynamic srv",
+		Upstream:    ref.SrvName(),
+		ServiceName: name,
+		Path:        path,
+		SrvUrls:     hosts,
+	}
+}
+
+func TestMergeServices(t *testing.T) {
+	type route struct {
+		host     string
+		path     string
+		to       string
+		upstream string
+	}
+
+	tests := []struct {
+		name           string
+		conflictPolicy string
+		upstreamMode   string
+		defs           []*parser.ServiceDef
+		routes         []route
+		conflicts      int
+	}{
+		{
+			name: "paths share a site",
+			defs: []*parser.ServiceDef{srvDef("web", "", "example.com"), srvDef("api", "/api", "example.com")},
+			routes: []route{
+				{"example.com", "/api", "dynamic srv", "api.service.consul"},
+				{"example.com", "", "dynamic srv", "web.service.consul"},
+			},
+		},
+		{
+			name:   "same site listed twice",
+			defs:   []*parser.ServiceDef{srvDef("web", "", "example.com", "Example.com:443")},
+			routes: []route{{"example.com", "", "dynamic srv", "web.service.consul"}},
+		},
+		{
+			name:      "same site listed twice by a conflicting service",
+			defs:      []*parser.ServiceDef{srvDef("web", "", "example.com", "Example.com:443"), srvDef("api", "", "example.com")},
+			routes:    []route{{"example.com", "", "dynamic srv", "api.service.consul"}},
+			conflicts: 1,
+		},
+		{
+			name:           "merged into a multi source",
+			conflictPolicy: config.ConflictPolicyMerge,
+			defs:           []*parser.ServiceDef{srvDef("web", "", "example.com", "Example.com:443"), srvDef("api", "", "example.com")},
+			routes:         []route{{"example.com", "", "dynamic multi", "api.service.consul web.service.consul"}},
+			conflicts:      1,
+		},
+		{
+			name:           "merged into a multi source with consul upstreams",
+			conflictPolicy: config.ConflictPolicyMerge,
+			upstreamMode:   config.UpstreamModeConsul,
+			defs:           []*parser.ServiceDef{srvDef("web", "", "example.com"), srvDef("api", "", "example.com")},
+			routes:         []route{{"example.com", "", "dynamic multi", "api web"}},
+			conflicts:      1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := &config.Options{
+				ConflictPolicy: test.conflictPolicy,
+				UpstreamMode:   test.upstreamMode,
+			}
+			if options.ConflictPolicy == "" {
+				options.ConflictPolicy = config.ConflictPolicyFirst
+			}
+			if options.UpstreamMode == "" {
+				options.UpstreamMode = config.UpstreamModeSrv
+			}
+
+			sites := mergeServices(options, &parser.Services{Services: test.defs}, nil, nil)
+
+			var routes []route
+			for _, hostGroup := range sites.hostGroups {
+				for _, def := range hostGroup.Services {
+					routes = append(routes, route{hostGroup.Host, def.Path, def.To, def.Upstream})
+				}
+			}
+			if !slices.Equal(routes, test.routes) {
+				t.Errorf("routes = %v, want %v", routes, test.routes)
+			}
+			if len(sites.conflicts) != test.conflicts {
+				t.Errorf("conflicts = %v, want %d", sites.conflicts, test.conflicts)
+			}
+		})
+	}
+}
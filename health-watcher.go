@@ -0,0 +1,283 @@
+package caddyconsulingress
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fortix/caddy-consul-ingress/parser"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+// Callers waiting for the first fetch of a service give up after this long, the watch keeps retrying
+const healthFirstFetchTimeout = 10 * time.Second
+
+// Watches the health of the routed services so upstreams can be generated without Consul DNS.
+//
+// The lock is never held while querying Consul, so reading the instances isn't held up by a slow or unreachable Consul.
+type HealthWatcher struct {
+	mutex       sync.RWMutex
+	logger      *zap.Logger
+	consul      *consul.Client
+	passingOnly bool
+	waitTime    time.Duration
+	onChange    func()
+	watches     map[parser.ServiceRef]*healthWatch
+	instances   map[parser.ServiceRef][]string
+	status      map[parser.ServiceRef]WatchStatus
+	refs        map[parser.ServiceRef]int
+}
+
+func NewHealthWatcher(logger *zap.Logger, consulClient *consul.Client, passingOnly bool, waitTime time.Duration, onChange func()) *HealthWatcher {
+	return &HealthWatcher{
+		mutex:       sync.RWMutex{},
+		logger:      logger,
+		consul:      consulClient,
+		passingOnly: passingOnly,
+		waitTime:    waitTime,
+		onChange:    onChange,
+		watches:     make(map[parser.ServiceRef]*healthWatch),
+		instances:   make(map[parser.ServiceRef][]string),
+		status:      make(map[parser.ServiceRef]WatchStatus),
+		refs:        make(map[parser.ServiceRef]int),
+	}
+}
+
+// A watched service
+type healthWatch struct {
+	cancel context.CancelFunc
+	ready  chan struct{} // Closed once the first fetch has completed or failed
+}
+
+// Update the watched services, waits for the first fetch of new services so the first config has their instances
+func (w *HealthWatcher) Watch(services []parser.ServiceRef) {
+	w.mutex.Lock()
+
+	wanted := make(map[parser.ServiceRef]bool)
+	watches := make([]*healthWatch, 0, len(services))
+	for _, service := range services {
+		wanted[service] = true
+		watches = append(watches, w.startWatch(service))
+	}
+
+	// Stop watching services that are no longer routed
+	for service := range w.watches {
+		if !wanted[service] {
+			w.stopWatch(service)
+		}
+	}
+
+	w.mutex.Unlock()
+
+	for _, watch := range watches {
+		<-watch.ready
+	}
+}
+
+// Watch a service until every acquire has been matched by a release, used when several users share the watcher.
+// Doesn't wait for the first fetch so services are fetched in parallel, the returned channel is closed once it completes or fails.
+func (w *HealthWatcher) Acquire(service parser.ServiceRef) <-chan struct{} {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.refs[service]++
+	return w.startWatch(service).ready
+}
+
+func (w *HealthWatcher) Release(service parser.ServiceRef) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.refs[service]--
+	if w.refs[service] <= 0 {
+		delete(w.refs, service)
+		w.stopWatch(service)
+	}
+}
+
+// Returns the healthy instances of a single service, the slice must not be modified
+func (w *HealthWatcher) ServiceInstances(service parser.ServiceRef) []string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	return w.instances[service]
+}
+
+// Start watching a service if not already watched and return its watch, the caller must hold the lock.
+// The first fetch happens in the background, wait on the ready channel of the watch with the lock released.
+func (w *HealthWatcher) startWatch(service parser.ServiceRef) *healthWatch {
+	if watch, ok := w.watches[service]; ok {
+		return watch
+	}
+
+	w.logger.Info("Watch health of service", zap.Stringer("service", service))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	watch := &healthWatch{cancel: cancel, ready: make(chan struct{})}
+	w.watches[service] = watch
+
+	go w.run(ctx, service, watch)
+
+	return watch
+}
+
+// Stop watching a service, the caller must hold the lock
+func (w *HealthWatcher) stopWatch(service parser.ServiceRef) {
+	watch, ok := w.watches[service]
+	if !ok {
+		return
+	}
+
+	w.logger.Info("Stop watching health of service", zap.Stringer("service", service))
+
+	watch.cancel()
+	delete(w.watches, service)
+	delete(w.instances, service)
+	delete(w.status, service)
+}
+
+// Returns a copy of the healthy instances of each watched service as address:port, keyed by the qualified service name
+func (w *HealthWatcher) Instances() map[string][]string {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	instances := make(map[string][]string, len(w.instances))
+	for service, addresses := range w.instances {
+		instances[service.String()] = slices.Clone(addresses)
+	}
+	return instances
+}
+
+// Returns the index and last contact with Consul of each watched service, keyed by the qualified service name
+func (w *HealthWatcher) Status() map[string]WatchStatus {
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	status := make(map[string]WatchStatus, len(w.status))
+	for service, serviceStatus := range w.status {
+		status[service.String()] = serviceStatus
+	}
+	return status
+}
+
+// Stop all the watches
+func (w *HealthWatcher) Stop() {
+	w.Watch(nil)
+}
+
+// Stop the watches once no upstream module shares the watcher
+func (w *HealthWatcher) Destruct() error {
+	w.Stop()
+	return nil
+}
+
+func (w *HealthWatcher) run(ctx context.Context, service parser.ServiceRef, watch *healthWatch) {
+	// Bound the first fetch as callers wait for it, a failure is retried by the watch below
+	firstCtx, cancel := context.WithTimeout(ctx, healthFirstFetchTimeout)
+	instances, index, err := w.fetch(firstCtx, service, 0)
+	cancel()
+
+	if err != nil {
+		if ctx.Err() == nil {
+			w.logger.Warn("Failed to retrieve service health from Consul", zap.Stringer("service", service), zap.Error(err))
+		}
+	} else {
+		w.mutex.Lock()
+		if ctx.Err() == nil {
+			w.instances[service] = instances
+			w.status[service] = WatchStatus{Index: index, LastContact: time.Now()}
+		}
+		w.mutex.Unlock()
+	}
+	close(watch.ready)
+
+	for {
+		instances, lastIndex, err := w.fetch(ctx, service, index)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != nil {
+			w.logger.Warn("Failed to retrieve service health from Consul", zap.Stringer("service", service), zap.Error(err))
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(5 * time.Second): // Wait before retrying
+			}
+			continue
+		}
+
+		w.mutex.Lock()
+		if ctx.Err() == nil {
+			w.status[service] = WatchStatus{Index: lastIndex, LastContact: time.Now()}
+		}
+		w.mutex.Unlock()
+
+		// Blocking query timed out without a change
+		if lastIndex == index {
+			continue
+		}
+
+		// If the index goes backwards then Consul has reset it so start again from 0
+		if lastIndex < index {
+			index = 0
+		} else {
+			index = lastIndex
+		}
+
+		w.mutex.Lock()
+		if ctx.Err() != nil {
+			w.mutex.Unlock()
+			return
+		}
+		changed := !slices.Equal(w.instances[service], instances)
+		w.instances[service] = instances
+		w.mutex.Unlock()
+
+		if changed {
+			w.logger.Info("Healthy instances changed", zap.Stringer("service", service), zap.Strings("instances", instances))
+			if w.onChange != nil {
+				w.onChange()
+			}
+		}
+	}
+}
+
+func (w *HealthWatcher) fetch(ctx context.Context, service parser.ServiceRef, index uint64) ([]string, uint64, error) {
+	params := service.Scope.QueryOptions()
+	params.WaitIndex = index
+	params.WaitTime = w.waitTime
+
+	entries, meta, err := w.consul.Health().Service(service.Name, "", w.passingOnly, params.WithContext(ctx))
+	if ctx.Err() == nil {
+		observeConsulRequest(watcherHealth, meta, err)
+	}
+	if err != nil {
+		return nil, index, err
+	}
+
+	instances := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		instances = append(instances, net.JoinHostPort(address, strconv.Itoa(entry.Service.Port)))
+	}
+	sort.Strings(instances)
+
+	return instances, meta.LastIndex, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Destructor = (*HealthWatcher)(nil)
+)
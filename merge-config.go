@@ -0,0 +1,192 @@
+package caddyconsulingress
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"slices"
+)
+
+// Key of the items of each list which are matched against requests, items with it come before the catch-alls without it
+var mergeListMatchKeys = map[string]string{
+	"routes":                  "match",
+	"tls_connection_policies": "match",
+	"policies":                "subjects",
+}
+
+// Merge the generated config into the config loaded from outside the ingress, so its sites, apps and global options
+// keep running alongside the generated sites.
+//
+// Settings of the loaded config take precedence, objects are merged key by key and lists are joined. HTTP servers
+// listening on the same addresses are merged into one, with routes and policies matching specific hosts first.
+func mergeConfig(base []byte, generated []byte) ([]byte, error) {
+	baseCfg, err := decodeConfig(base)
+	if err != nil {
+		return nil, err
+	}
+
+	generatedCfg, err := decodeConfig(generated)
+	if err != nil {
+		return nil, err
+	}
+
+	alignServers(baseCfg, generatedCfg)
+
+	return json.Marshal(mergeValues(baseCfg, generatedCfg, ""))
+}
+
+// Returns true if both configs decode to the same values, the admin API doesn't return the config byte for byte as it was loaded
+func sameConfig(a []byte, b []byte) bool {
+	aCfg, err := decodeConfig(a)
+	if err != nil {
+		return false
+	}
+
+	bCfg, err := decodeConfig(b)
+	if err != nil {
+		return false
+	}
+
+	return reflect.DeepEqual(aCfg, bCfg)
+}
+
+// Decode a config keeping numbers as they are written
+func decodeConfig(cfgJSON []byte) (map[string]any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(cfgJSON))
+	decoder.UseNumber()
+
+	cfg := make(map[string]any)
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Rename the generated HTTP servers to the server of the loaded config listening on the same addresses, so they are
+// merged into it, and give the others a name the loaded config doesn't use
+func alignServers(base map[string]any, generated map[string]any) {
+	baseServers := httpServers(base)
+	generatedServers := httpServers(generated)
+	if baseServers == nil || generatedServers == nil {
+		return
+	}
+
+	renamed := make(map[string]any, len(generatedServers))
+	for name, server := range generatedServers {
+		newName := ""
+		for baseName, baseServer := range baseServers {
+			if sameListeners(baseServer, server) {
+				newName = baseName
+				break
+			}
+		}
+
+		if newName == "" {
+			newName = name
+			for {
+				_, inBase := baseServers[newName]
+				_, inRenamed := renamed[newName]
+				if !inBase && !inRenamed {
+					break
+				}
+				newName = "consul_ingress_" + newName
+			}
+		}
+
+		renamed[newName] = server
+	}
+
+	generated["apps"].(map[string]any)["http"].(map[string]any)["servers"] = renamed
+}
+
+// Returns the servers of the HTTP app of the config, nil if there aren't any
+func httpServers(cfg map[string]any) map[string]any {
+	apps, _ := cfg["apps"].(map[string]any)
+	httpApp, _ := apps["http"].(map[string]any)
+	servers, _ := httpApp["servers"].(map[string]any)
+	return servers
+}
+
+// Returns true if both servers listen on the same addresses
+func sameListeners(a any, b any) bool {
+	listeners := func(server any) []string {
+		serverCfg, _ := server.(map[string]any)
+		listen, _ := serverCfg["listen"].([]any)
+
+		addresses := make([]string, 0, len(listen))
+		for _, address := range listen {
+			if address, ok := address.(string); ok {
+				addresses = append(addresses, address)
+			}
+		}
+		slices.Sort(addresses)
+		return slices.Compact(addresses)
+	}
+
+	return slices.Equal(listeners(a), listeners(b))
+}
+
+// Merge a generated value into the value of the loaded config under the same key
+func mergeValues(base any, generated any, key string) any {
+	switch baseValue := base.(type) {
+	case map[string]any:
+		generatedValue, ok := generated.(map[string]any)
+		if !ok {
+			return base
+		}
+
+		merged := make(map[string]any, len(baseValue)+len(generatedValue))
+		for k, v := range baseValue {
+			merged[k] = v
+		}
+		for k, v := range generatedValue {
+			if baseV, ok := merged[k]; ok {
+				merged[k] = mergeValues(baseV, v, k)
+			} else {
+				merged[k] = v
+			}
+		}
+		return merged
+
+	case []any:
+		generatedValue, ok := generated.([]any)
+		if !ok {
+			return base
+		}
+		return mergeLists(baseValue, generatedValue, mergeListMatchKeys[key])
+
+	default:
+		return base
+	}
+}
+
+// Join two lists dropping duplicates, if a match key is given the items with it come first so catch-alls stay last
+func mergeLists(base []any, generated []any, matchKey string) []any {
+	merged := make([]any, 0, len(base)+len(generated))
+	add := func(items []any, specific bool) {
+		for _, item := range items {
+			if matchKey != "" {
+				itemCfg, _ := item.(map[string]any)
+				if _, ok := itemCfg[matchKey]; ok != specific {
+					continue
+				}
+			}
+
+			if !slices.ContainsFunc(merged, func(m any) bool { return reflect.DeepEqual(m, item) }) {
+				merged = append(merged, item)
+			}
+		}
+	}
+
+	if matchKey == "" {
+		add(base, false)
+		add(generated, false)
+		return merged
+	}
+
+	add(base, true)
+	add(generated, true)
+	add(base, false)
+	add(generated, false)
+	return merged
+}
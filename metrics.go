@@ -0,0 +1,185 @@
+package caddyconsulingress
+
+import (
+	"encoding/hex"
+	"time"
+
+	"github.com/fortix/caddy-consul-ingress/parser"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Sources of routes
+const (
+	sourceCatalog = "catalog"
+	sourceKV      = "kv"
+)
+
+// Watchers querying Consul
+const (
+	watcherCatalog  = "catalog"
+	watcherInstance = "instance"
+	watcherKV       = "kv"
+	watcherHealth   = "health"
+	watcherScopes   = "scopes"
+	watcherLeader   = "leader"
+)
+
+// Stages of an update which can fail
+const (
+	stageGenerate = "generate"
+	stageAdapt    = "adapt"
+	stageLoad     = "load"
+)
+
+// Metrics are registered with the default registry which Caddy serves from the admin API and the metrics handler
+var ingressMetrics = struct {
+	services       prometheus.Gauge
+	routes         *prometheus.GaugeVec
+	updates        prometheus.Counter
+	updateDuration prometheus.Histogram
+	failures       *prometheus.CounterVec
+	consulDuration *prometheus.HistogramVec
+	consulErrors   *prometheus.CounterVec
+	lastSync       prometheus.Gauge
+	configHash     *prometheus.GaugeVec
+	conflicts      prometheus.Gauge
+	leader         prometheus.Gauge
+}{}
+
+func init() {
+	const ns, sub = "caddy", "consul_ingress"
+
+	ingressMetrics.services = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "services",
+		Help:      "Number of Consul services routed to.",
+	})
+	ingressMetrics.routes = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "routes",
+		Help:      "Number of routed URLs by source, catalog or kv.",
+	}, []string{"source"})
+	ingressMetrics.updates = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "config_updates_total",
+		Help:      "Number of times the config was generated.",
+	})
+	ingressMetrics.updateDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "config_update_duration_seconds",
+		Help:      "Time taken to generate, adapt and load the config.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	ingressMetrics.failures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "config_failures_total",
+		Help:      "Number of config updates which failed by stage, generate, adapt or load.",
+	}, []string{"stage"})
+	ingressMetrics.consulDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "consul_request_duration_seconds",
+		Help:      "Time taken by requests to Consul by watcher, blocking queries include the time spent waiting for a change.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+	}, []string{"watcher"})
+	ingressMetrics.consulErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "consul_errors_total",
+		Help:      "Number of failed requests to Consul by watcher.",
+	}, []string{"watcher"})
+	ingressMetrics.lastSync = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "last_sync_timestamp_seconds",
+		Help:      "Time the config was last brought in sync with Consul.",
+	})
+	ingressMetrics.configHash = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "config_info",
+		Help:      "Hash of the loaded config, the value is always 1.",
+	}, []string{"hash"})
+	ingressMetrics.conflicts = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "conflicts",
+		Help:      "Number of URLs claimed by more than one service in the last generated config.",
+	})
+	ingressMetrics.leader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "leader",
+		Help:      "1 if this replica holds the leader lock or leader election is disabled, 0 otherwise.",
+	})
+}
+
+// Record a request to Consul made by the watcher
+func observeConsulRequest(watcher string, meta *consul.QueryMeta, err error) {
+	if err != nil {
+		ingressMetrics.consulErrors.WithLabelValues(watcher).Inc()
+		return
+	}
+
+	if meta != nil {
+		ingressMetrics.consulDuration.WithLabelValues(watcher).Observe(meta.RequestTime.Seconds())
+	}
+}
+
+// Record the number of services and routes being generated
+func observeServices(serviceDefs *parser.Services, kvServiceDefs *parser.Services) {
+	ingressMetrics.services.Set(float64(len(parser.ServiceRefs(serviceDefs, kvServiceDefs))))
+	ingressMetrics.routes.WithLabelValues(sourceCatalog).Set(float64(countRoutes(serviceDefs)))
+	ingressMetrics.routes.WithLabelValues(sourceKV).Set(float64(countRoutes(kvServiceDefs)))
+}
+
+// Record a config which has been loaded
+func observeLoaded(hash string) {
+	ingressMetrics.configHash.Reset()
+	ingressMetrics.configHash.WithLabelValues(hex.EncodeToString([]byte(hash))).Set(1)
+}
+
+// Record that the running config matches the services in Consul
+func observeSynced() {
+	ingressMetrics.lastSync.Set(float64(time.Now().Unix()))
+}
+
+// Record whether this replica holds the leader lock
+func observeLeader(leader bool) {
+	if leader {
+		ingressMetrics.leader.Set(1)
+	} else {
+		ingressMetrics.leader.Set(0)
+	}
+}
+
+// Returns the number of URLs routed, including the default handlers of wildcard domains
+func countRoutes(services *parser.Services) int {
+	if services == nil {
+		return 0
+	}
+
+	routes := 0
+	for _, def := range services.Services {
+		routes += len(def.SrvUrls)
+	}
+
+	for _, serviceGroup := range services.ServiceGroups {
+		if serviceGroup.Upstream != "" {
+			routes++
+		}
+		for _, def := range serviceGroup.Services {
+			routes += len(def.SrvUrls)
+		}
+	}
+
+	return routes
+}
@@ -1,13 +1,118 @@
 package caddyconsulingress
 
-import "github.com/caddyserver/caddy/v2"
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+	"github.com/fortix/caddy-consul-ingress/generator"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
 
 func init() {
 	caddy.RegisterModule(CaddyConsulIngress{})
+	caddy.RegisterModule(ConsulUpstreams{})
+	caddy.RegisterModule(AdminAPI{})
+	caddy.RegisterModule(ConsulStorage{})
+	caddy.RegisterModule(ConsulIngressPermission{})
+	caddy.RegisterModule(ConsulCertificates{})
 }
 
-// Caddy docker proxy module
+// Clients shared between config reloads, keyed by the app config so a changed config starts a new client
+var clients = caddy.NewUsagePool()
+
+// Caddy consul ingress app, generates the Caddy config from the services registered in Consul
 type CaddyConsulIngress struct {
+	// A template file that the Caddyfile is generated from, defaults to the built in template
+	TemplateFile string `json:"template,omitempty"`
+
+	// Address of the Consul server, defaults to CONSUL_HTTP_ADDR or http://localhost:8500
+	ConsulAddress string `json:"consul_address,omitempty"`
+
+	// Access token for Consul
+	ConsulToken string `json:"consul_token,omitempty"`
+
+	// CA certificate file to verify Consul with, defaults to CONSUL_CACERT
+	ConsulCAFile string `json:"consul_ca_file,omitempty"`
+
+	// Directory of CA certificates to verify Consul with, defaults to CONSUL_CAPATH
+	ConsulCAPath string `json:"consul_ca_path,omitempty"`
+
+	// Client certificate file to authenticate with Consul, defaults to CONSUL_CLIENT_CERT
+	ConsulCertFile string `json:"consul_cert_file,omitempty"`
+
+	// Client key file to authenticate with Consul, defaults to CONSUL_CLIENT_KEY
+	ConsulKeyFile string `json:"consul_key_file,omitempty"`
+
+	// Server name to verify the Consul certificate against, defaults to CONSUL_TLS_SERVER_NAME
+	ConsulTLSServerName string `json:"consul_tls_server_name,omitempty"`
+
+	// Skip verifying the Consul certificate, defaults to false unless CONSUL_HTTP_SSL_VERIFY is false
+	ConsulTLSSkipVerify bool `json:"consul_tls_skip_verify,omitempty"`
+
+	// Datacenters to read services and routes from, * for all, defaults to the datacenter of the Consul agent
+	Datacenters []string `json:"datacenters,omitempty"`
+
+	// Datacenters to use the instances of a service from in order when it has no healthy instances, unless set by the failover option
+	FailoverDatacenters []string `json:"failover_datacenters,omitempty"`
+
+	// Consul Enterprise namespaces to read services and routes from, * for all, defaults to the namespace of the token
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// Consul Enterprise admin partitions to read services and routes from, * for all, defaults to the partition of the token
+	Partitions []string `json:"partitions,omitempty"`
+
+	// Prefix for the tags defining service URLs, defaults to urlprefix-
+	UrlPrefix string `json:"url_prefix,omitempty"`
+
+	// Prefix for the service meta keys defining service URLs and options, defaults to caddy-, empty to disable
+	MetaPrefix *string `json:"meta_prefix,omitempty"`
+
+	// Path to the Consul KV store for custom routes, defaults to /caddy-routes, empty to disable
+	KVPath *string `json:"kv_path,omitempty"`
+
+	// Prefix of the KV keys to store certificates, keys and locks under so replicas share them, empty to use the storage of the generated config
+	StoragePrefix string `json:"storage_prefix,omitempty"`
+
+	// KV key of the lock electing a leader among the replicas sharing it, empty to disable leader election
+	LeaderKey string `json:"leader_key,omitempty"`
+
+	// Wildcard domains to group services by
+	WildcardDomains []string `json:"wildcard_domains,omitempty"`
+
+	// Interval caddy should manually check consul for updated services, defaults to 30s
+	PollingInterval caddy.Duration `json:"polling_interval,omitempty"`
+
+	// Wait for changes in Consul to settle for this long before updating the config, defaults to 1s, 0 to update on every change
+	DebounceWindow *caddy.Duration `json:"debounce,omitempty"`
+
+	// Update the config at most this long after the first of a burst of changes, defaults to 10s, 0 for no limit
+	DebounceMaxDelay *caddy.Duration `json:"debounce_max_delay,omitempty"`
+
+	// How service upstreams are resolved, srv, health or consul, defaults to srv
+	UpstreamMode string `json:"upstreams,omitempty"`
+
+	// How the config is generated, caddyfile from the template or json directly, defaults to caddyfile
+	ConfigFormat string `json:"config_format,omitempty"`
+
+	// How services claiming the same URL are resolved, first, kv, priority or merge, defaults to first
+	ConflictPolicy string `json:"conflict_policy,omitempty"`
+
+	// Only route to instances passing their health checks, defaults to true
+	HealthPassingOnly *bool `json:"passing_only,omitempty"`
+
+	// Set the log level to debug
+	Verbose bool `json:"verbose,omitempty"`
+
+	// Restart caddy when the Caddyfile changes
+	RestartOnCfgChange bool `json:"restart_on_cfg_change,omitempty"`
+
+	key    string
+	client *ConsulIngressClient
 }
 
 // CaddyModule returns the Caddy module information.
@@ -17,3 +122,205 @@ func (CaddyConsulIngress) CaddyModule() caddy.ModuleInfo {
 		New: func() caddy.Module { return new(CaddyConsulIngress) },
 	}
 }
+
+// Create the app config from the options
+func NewCaddyConsulIngress(options *config.Options) *CaddyConsulIngress {
+	return &CaddyConsulIngress{
+		TemplateFile:        options.TemplateFile,
+		ConsulAddress:       options.ConsulAddress,
+		ConsulToken:         options.ConsulToken,
+		ConsulCAFile:        options.ConsulCAFile,
+		ConsulCAPath:        options.ConsulCAPath,
+		ConsulCertFile:      options.ConsulCertFile,
+		ConsulKeyFile:       options.ConsulKeyFile,
+		ConsulTLSServerName: options.ConsulTLSServerName,
+		ConsulTLSSkipVerify: options.ConsulTLSSkipVerify,
+		Datacenters:         options.Datacenters,
+		FailoverDatacenters: options.FailoverDatacenters,
+		Namespaces:          options.Namespaces,
+		Partitions:          options.Partitions,
+		UrlPrefix:           options.UrlPrefix,
+		MetaPrefix:          &options.MetaPrefix,
+		KVPath:              &options.KVPath,
+		StoragePrefix:       options.StoragePrefix,
+		LeaderKey:           options.LeaderKey,
+		WildcardDomains:     options.WildcardDomains,
+		PollingInterval:     caddy.Duration(options.PollingInterval),
+		DebounceWindow:      (*caddy.Duration)(&options.DebounceWindow),
+		DebounceMaxDelay:    (*caddy.Duration)(&options.DebounceMaxDelay),
+		UpstreamMode:        options.UpstreamMode,
+		ConfigFormat:        options.ConfigFormat,
+		ConflictPolicy:      options.ConflictPolicy,
+		HealthPassingOnly:   &options.HealthPassingOnly,
+		Verbose:             options.Verbose,
+		RestartOnCfgChange:  options.RestartOnCfgChange,
+	}
+}
+
+// Returns the options for the client with the defaults applied, an error if any are invalid
+func (app *CaddyConsulIngress) options(logger *zap.Logger) (*config.Options, error) {
+	options := &config.Options{
+		TemplateFile:        app.TemplateFile,
+		ConsulAddress:       app.ConsulAddress,
+		ConsulToken:         app.ConsulToken,
+		ConsulCAFile:        app.ConsulCAFile,
+		ConsulCAPath:        app.ConsulCAPath,
+		ConsulCertFile:      app.ConsulCertFile,
+		ConsulKeyFile:       app.ConsulKeyFile,
+		ConsulTLSServerName: app.ConsulTLSServerName,
+		ConsulTLSSkipVerify: app.ConsulTLSSkipVerify,
+		Datacenters:         app.Datacenters,
+		FailoverDatacenters: app.FailoverDatacenters,
+		Namespaces:          app.Namespaces,
+		Partitions:          app.Partitions,
+		UrlPrefix:           app.UrlPrefix,
+		MetaPrefix:          "caddy-",
+		KVPath:              "/caddy-routes",
+		StoragePrefix:       app.StoragePrefix,
+		LeaderKey:           app.LeaderKey,
+		WildcardDomains:     []string{},
+		PollingInterval:     time.Duration(app.PollingInterval),
+		DebounceWindow:      time.Second,
+		DebounceMaxDelay:    10 * time.Second,
+		UpstreamMode:        app.UpstreamMode,
+		ConfigFormat:        app.ConfigFormat,
+		ConflictPolicy:      app.ConflictPolicy,
+		HealthPassingOnly:   true,
+		Verbose:             app.Verbose,
+		RestartOnCfgChange:  app.RestartOnCfgChange,
+		Logger:              logger,
+	}
+
+	if options.UrlPrefix == "" {
+		options.UrlPrefix = "urlprefix-"
+	}
+	if app.MetaPrefix != nil {
+		options.MetaPrefix = *app.MetaPrefix
+	}
+	if app.KVPath != nil {
+		options.KVPath = *app.KVPath
+	}
+	if options.PollingInterval <= 0 {
+		options.PollingInterval = 30 * time.Second
+	}
+	if app.DebounceWindow != nil {
+		options.DebounceWindow = time.Duration(*app.DebounceWindow)
+	}
+	if app.DebounceMaxDelay != nil {
+		options.DebounceMaxDelay = time.Duration(*app.DebounceMaxDelay)
+	}
+	if options.UpstreamMode == "" {
+		options.UpstreamMode = config.UpstreamModeSrv
+	}
+	if options.ConfigFormat == "" {
+		options.ConfigFormat = config.ConfigFormatCaddyfile
+	}
+	if options.ConflictPolicy == "" {
+		options.ConflictPolicy = config.ConflictPolicyFirst
+	}
+	if app.HealthPassingOnly != nil {
+		options.HealthPassingOnly = *app.HealthPassingOnly
+	}
+
+	// Ignore empty domains left by splitting an empty list
+	for _, wildcardDomain := range app.WildcardDomains {
+		if strings.TrimSpace(wildcardDomain) != "" {
+			options.WildcardDomains = append(options.WildcardDomains, wildcardDomain)
+		}
+	}
+
+	switch options.UpstreamMode {
+	case config.UpstreamModeSrv, config.UpstreamModeHealth, config.UpstreamModeConsul:
+	default:
+		return nil, fmt.Errorf("unknown upstream mode %q", options.UpstreamMode)
+	}
+
+	switch options.ConfigFormat {
+	case config.ConfigFormatCaddyfile, config.ConfigFormatJSON:
+	default:
+		return nil, fmt.Errorf("unknown config format %q", options.ConfigFormat)
+	}
+
+	switch options.ConflictPolicy {
+	case config.ConflictPolicyFirst, config.ConflictPolicyKV, config.ConflictPolicyPriority, config.ConflictPolicyMerge:
+	default:
+		return nil, fmt.Errorf("unknown conflict policy %q", options.ConflictPolicy)
+	}
+
+	return options, nil
+}
+
+func (app *CaddyConsulIngress) Provision(ctx caddy.Context) error {
+	options, err := app.options(ctx.Logger())
+	if err != nil {
+		return err
+	}
+
+	// Upstream and storage modules use the same connection to Consul, set before they are provisioned as they load the app first
+	if options.UpstreamMode == config.UpstreamModeConsul {
+		SetUpstreamDefaults(options)
+	}
+	SetStorageDefaults(options)
+
+	appConfig, err := json.Marshal(app)
+	if err != nil {
+		return err
+	}
+
+	// Reuse the running client if the config is unchanged, the generated config contains the app so every reload provisions it again
+	app.key = string(appConfig)
+	client, loaded, err := clients.LoadOrNew(app.key, func() (caddy.Destructor, error) {
+		// Fail on a broken template at startup rather than on the first change in Consul
+		if options.ConfigFormat == config.ConfigFormatCaddyfile {
+			if err := generator.NewGenerator(options.Logger, options).Validate(); err != nil {
+				return nil, fmt.Errorf("invalid template %q: %w", options.TemplateFile, err)
+			}
+		}
+
+		return NewConsulIngressClient(options, appConfig), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	app.client = client.(*ConsulIngressClient)
+
+	// The config may have been loaded from outside the ingress without the generated sites
+	if loaded {
+		app.client.provisioned()
+	}
+
+	return nil
+}
+
+func (app *CaddyConsulIngress) Start() error {
+	if err := app.client.Start(); err != nil {
+		return err
+	}
+
+	activeClient.Store(app.client)
+	return nil
+}
+
+// The client keeps running until no config uses it, see Cleanup
+func (app *CaddyConsulIngress) Stop() error {
+	return nil
+}
+
+func (app *CaddyConsulIngress) Cleanup() error {
+	if app.client != nil {
+		deleted, err := clients.Delete(app.key)
+		if deleted {
+			activeClient.CompareAndSwap(app.client, nil)
+		}
+		return err
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.App          = (*CaddyConsulIngress)(nil)
+	_ caddy.Provisioner  = (*CaddyConsulIngress)(nil)
+	_ caddy.CleanerUpper = (*CaddyConsulIngress)(nil)
+)
@@ -0,0 +1,181 @@
+package parser
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+)
+
+// Services claiming the same host and path, and how the conflict was resolved
+type Conflict struct {
+	Host string `json:"host"`
+	Path string `json:"path,omitempty"`
+
+	// Names of the services claiming the URL in order of precedence, the first is routed to unless merged
+	Services []string `json:"services"`
+
+	Policy string `json:"policy"`
+	Merged bool   `json:"merged"`
+}
+
+func (c Conflict) String() string {
+	resolution := "routed to " + c.Services[0]
+	if c.Merged {
+		resolution = "merged"
+	}
+	return fmt.Sprintf("%s%s claimed by %s, %s", c.Host, c.Path, strings.Join(c.Services, ", "), resolution)
+}
+
+// A service claiming a URL, FromKV is true for a KV route
+type Claim struct {
+	Def    *ServiceDef
+	FromKV bool
+}
+
+// Name identifying the service a definition routes to, the Consul service qualified by its scope or the upstream
+func (def *ServiceDef) Name() string {
+	if def.ServiceName != "" {
+		return def.Service().String()
+	}
+	return def.Upstream
+}
+
+// Resolve the services claiming the same host and path under the policy, returns the service to route to and the conflict,
+// the conflict is nil if the claims all route to the same service. With the merge policy the returned service is a new
+// definition without any URLs.
+func ResolveConflict(policy string, host string, path string, claims []Claim) (*ServiceDef, *Conflict) {
+	sorted := make([]Claim, len(claims))
+	copy(sorted, claims)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return precedes(policy, sorted[i], sorted[j])
+	})
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, claim := range sorted {
+		if name := claim.Def.Name(); !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	winner := sorted[0].Def
+	if len(names) == 1 {
+		return winner, nil
+	}
+
+	conflict := &Conflict{
+		Host:     host,
+		Path:     path,
+		Services: names,
+		Policy:   policy,
+	}
+
+	if policy == config.ConflictPolicyMerge {
+		if merged := mergeUpstreams(sorted); merged != nil {
+			conflict.Merged = true
+			return merged, conflict
+		}
+	}
+
+	return winner, conflict
+}
+
+// Returns true if the claim a takes precedence over b under the policy, ties go to the first by name
+func precedes(policy string, a Claim, b Claim) bool {
+	switch policy {
+	case config.ConflictPolicyKV:
+		if a.FromKV != b.FromKV {
+			return a.FromKV
+		}
+	case config.ConflictPolicyPriority:
+		if a.Def.Priority != b.Def.Priority {
+			return a.Def.Priority > b.Def.Priority
+		}
+	}
+
+	return a.Def.Name() < b.Def.Name()
+}
+
+// Returns a service proxying to the upstreams of all the claims with the options of the first, nil if static upstreams
+// are mixed with upstreams resolved dynamically or they don't share a scheme
+func mergeUpstreams(claims []Claim) *ServiceDef {
+	if claims[0].Def.To != "to" {
+		return mergeSources(claims)
+	}
+
+	var upstreams []string
+	var scheme string
+	seen := make(map[string]bool)
+	for _, claim := range claims {
+		if claim.Def.To != "to" {
+			return nil
+		}
+
+		for _, upstream := range strings.Fields(claim.Def.Upstream) {
+			// Upstreams without a scheme use HTTP, Caddy requires the same form for all the upstreams so the scheme is dropped
+			upstreamScheme, address, found := strings.Cut(upstream, "://")
+			if !found {
+				upstreamScheme = "http"
+			} else if upstreamScheme == "http" {
+				if _, _, err := net.SplitHostPort(address); err != nil {
+					address = net.JoinHostPort(address, "80")
+				}
+				upstream = address
+			}
+			if len(upstreams) == 0 {
+				scheme = upstreamScheme
+			} else if upstreamScheme != scheme {
+				return nil
+			}
+
+			if !seen[upstream] {
+				seen[upstream] = true
+				upstreams = append(upstreams, upstream)
+			}
+		}
+	}
+
+	merged := claims[0].Def.cloneWithoutUrls()
+	merged.Upstream = strings.Join(upstreams, " ")
+	return merged
+}
+
+// Returns a service combining the dynamic upstream sources of all the claims into a multi source with the options of the first,
+// nil if any of the upstreams are static
+func mergeSources(claims []Claim) *ServiceDef {
+	var sources []*ServiceDef
+	var upstreams []string
+	seen := make(map[string]bool)
+	for _, claim := range claims {
+		if claim.Def.To != "dynamic srv" && claim.Def.To != "dynamic consul" {
+			return nil
+		}
+
+		key := claim.Def.To + " " + claim.Def.Name()
+		if !seen[key] {
+			seen[key] = true
+			sources = append(sources, claim.Def.cloneWithoutUrls())
+			upstreams = append(upstreams, claim.Def.Upstream)
+		}
+	}
+
+	merged := claims[0].Def.cloneWithoutUrls()
+	merged.To = "dynamic multi"
+	merged.Upstream = strings.Join(upstreams, " ")
+	merged.Sources = sources
+	return merged
+}
+
+// Sort conflicts by host and path
+func SortConflicts(conflicts []Conflict) {
+	sort.Slice(conflicts, func(i, j int) bool {
+		if conflicts[i].Host != conflicts[j].Host {
+			return conflicts[i].Host < conflicts[j].Host
+		}
+		return conflicts[i].Path < conflicts[j].Path
+	})
+}
@@ -0,0 +1,193 @@
+package parser
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+)
+
+func srvDef(name string, priority int) *ServiceDef {
+	ref := ServiceRef{Name: name}
+	return &ServiceDef{
+		To:             "dynamic srv",
+		Upstream:       ref.SrvName(),
+		ServiceName:    name,
+		SrvUrls:        []string{"example.com"},
+		ServiceOptions: ServiceOptions{Priority: priority},
+	}
+}
+
+func staticDef(upstream string) *ServiceDef {
+	return &ServiceDef{To: "to", Upstream: upstream, SrvUrls: []string{"example.com"}}
+}
+
+func TestResolveConflict(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		claims   []Claim
+		to       string
+		upstream string
+		merged   bool
+		conflict bool
+	}{
+		{
+			name:     "same service",
+			policy:   config.ConflictPolicyFirst,
+			claims:   []Claim{{Def: srvDef("web", 0)}, {Def: srvDef("web", 0)}},
+			to:       "dynamic srv",
+			upstream: "web.service.consul",
+		},
+		{
+			name:     "first by name",
+			policy:   config.ConflictPolicyFirst,
+			claims:   []Claim{{Def: srvDef("web", 0)}, {Def: srvDef("api", 0), FromKV: true}},
+			to:       "dynamic srv",
+			upstream: "api.service.consul",
+			conflict: true,
+		},
+		{
+			name:     "kv",
+			policy:   config.ConflictPolicyKV,
+			claims:   []Claim{{Def: srvDef("api", 0)}, {Def: srvDef("web", 0), FromKV: true}},
+			to:       "dynamic srv",
+			upstream: "web.service.consul",
+			conflict: true,
+		},
+		{
+			name:     "kv without a KV route",
+			policy:   config.ConflictPolicyKV,
+			claims:   []Claim{{Def: srvDef("web", 0)}, {Def: srvDef("api", 0)}},
+			to:       "dynamic srv",
+			upstream: "api.service.consul",
+			conflict: true,
+		},
+		{
+			name:     "priority",
+			policy:   config.ConflictPolicyPriority,
+			claims:   []Claim{{Def: srvDef("api", 1)}, {Def: srvDef("web", 5)}},
+			to:       "dynamic srv",
+			upstream: "web.service.consul",
+			conflict: true,
+		},
+		{
+			name:     "priority tie",
+			policy:   config.ConflictPolicyPriority,
+			claims:   []Claim{{Def: srvDef("web", 2)}, {Def: srvDef("api", 2)}},
+			to:       "dynamic srv",
+			upstream: "api.service.consul",
+			conflict: true,
+		},
+		{
+			name:     "merge static upstreams",
+			policy:   config.ConflictPolicyMerge,
+			claims:   []Claim{{Def: staticDef("http://10.0.0.1:80")}, {Def: staticDef("10.0.0.2:80 10.0.0.1:80")}},
+			to:       "to",
+			upstream: "10.0.0.2:80 10.0.0.1:80",
+			merged:   true,
+			conflict: true,
+		},
+		{
+			name:     "merge static upstreams with different schemes",
+			policy:   config.ConflictPolicyMerge,
+			claims:   []Claim{{Def: staticDef("https://10.0.0.2")}, {Def: staticDef("http://10.0.0.1")}},
+			to:       "to",
+			upstream: "http://10.0.0.1",
+			conflict: true,
+		},
+		{
+			name:     "merge dynamic upstreams",
+			policy:   config.ConflictPolicyMerge,
+			claims:   []Claim{{Def: srvDef("web", 0)}, {Def: srvDef("api", 0)}},
+			to:       "dynamic multi",
+			upstream: "api.service.consul web.service.consul",
+			merged:   true,
+			conflict: true,
+		},
+		{
+			name:     "merge static with dynamic upstreams",
+			policy:   config.ConflictPolicyMerge,
+			claims:   []Claim{{Def: srvDef("web", 0)}, {Def: staticDef("http://10.0.0.1:80")}},
+			to:       "to",
+			upstream: "http://10.0.0.1:80",
+			conflict: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			def, conflict := ResolveConflict(test.policy, "example.com", "", test.claims)
+			if def.To != test.to || def.Upstream != test.upstream {
+				t.Errorf("routed to %s %s, want %s %s", def.To, def.Upstream, test.to, test.upstream)
+			}
+			if (conflict != nil) != test.conflict {
+				t.Fatalf("conflict = %v, want conflict %v", conflict, test.conflict)
+			}
+			if conflict != nil && conflict.Merged != test.merged {
+				t.Errorf("merged = %v, want %v", conflict.Merged, test.merged)
+			}
+			if test.merged && len(def.SrvUrls) != 0 {
+				t.Errorf("merged service has URLs %q", def.SrvUrls)
+			}
+		})
+	}
+}
+
+func TestMergeSources(t *testing.T) {
+	consulDef := &ServiceDef{To: "dynamic consul", Upstream: "db", ServiceName: "db", SrvUrls: []string{"example.com"}}
+
+	tests := []struct {
+		name     string
+		claims   []Claim
+		upstream string
+		sources  []string
+	}{
+		{
+			name:     "srv sources",
+			claims:   []Claim{{Def: srvDef("api", 0)}, {Def: srvDef("web", 0)}},
+			upstream: "api.service.consul web.service.consul",
+			sources:  []string{"dynamic srv api.service.consul", "dynamic srv web.service.consul"},
+		},
+		{
+			name:     "duplicate sources",
+			claims:   []Claim{{Def: srvDef("api", 0)}, {Def: srvDef("api", 0)}, {Def: srvDef("web", 0)}},
+			upstream: "api.service.consul web.service.consul",
+			sources:  []string{"dynamic srv api.service.consul", "dynamic srv web.service.consul"},
+		},
+		{
+			name:     "srv and consul sources",
+			claims:   []Claim{{Def: srvDef("api", 0)}, {Def: consulDef}},
+			upstream: "api.service.consul db",
+			sources:  []string{"dynamic srv api.service.consul", "dynamic consul db"},
+		},
+		{
+			name:   "static upstream",
+			claims: []Claim{{Def: srvDef("api", 0)}, {Def: staticDef("http://10.0.0.1:80")}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			merged := mergeSources(test.claims)
+			if test.sources == nil {
+				if merged != nil {
+					t.Fatalf("merged to %s %s, want nil", merged.To, merged.Upstream)
+				}
+				return
+			}
+
+			if merged.To != "dynamic multi" || merged.Upstream != test.upstream {
+				t.Errorf("merged to %s %s, want dynamic multi %s", merged.To, merged.Upstream, test.upstream)
+			}
+
+			var sources []string
+			for _, source := range merged.Sources {
+				sources = append(sources, source.To+" "+source.Upstream)
+			}
+			if !slices.Equal(sources, test.sources) {
+				t.Errorf("sources = %q, want %q", sources, test.sources)
+			}
+		})
+	}
+}
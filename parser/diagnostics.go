@@ -0,0 +1,290 @@
+package parser
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+
+	"go.uber.org/zap"
+)
+
+// A problem found in the tags, meta or KV routes which the parser ignored or which may not route as intended
+type Diagnostic struct {
+	// Name of the service or the KV key
+	Source string `json:"source"`
+
+	// Line of the KV value, 0 for services
+	Line int `json:"line,omitempty"`
+
+	Message string `json:"message"`
+
+	// The tag, route, option or URL the diagnostic is about
+	Value string `json:"value,omitempty"`
+}
+
+func (d Diagnostic) String() string {
+	source := d.Source
+	if d.Line > 0 {
+		source += ":" + strconv.Itoa(d.Line)
+	}
+
+	if d.Value == "" {
+		return fmt.Sprintf("%s: %s", source, d.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", source, d.Message, d.Value)
+}
+
+// Where a tag or route was read from
+type routeSource struct {
+	name string
+	line int
+}
+
+// KV routes are read line by line, services have no line
+func (s routeSource) fromKV() bool {
+	return s.line > 0
+}
+
+func (s routeSource) String() string {
+	if s.line > 0 {
+		return s.name + ":" + strconv.Itoa(s.line)
+	}
+	return s.name
+}
+
+// A URL routed to a service, used to find hosts claimed by more than one service
+type routedUrl struct {
+	source routeSource
+	def    *ServiceDef
+	srvUrl string
+}
+
+// Diagnostics recorded by a strict parser
+type diagnostics struct {
+	mutex sync.Mutex
+	list  []Diagnostic
+	urls  map[string][]routedUrl
+}
+
+// Create a parser which records a diagnostic for everything it ignores or which may not route as intended, see Diagnostics
+func NewStrictParser(log *zap.Logger, options *config.Options) *ServiceParser {
+	p := NewParser(log, options)
+	p.diagnostics = &diagnostics{
+		urls: make(map[string][]routedUrl),
+	}
+	return p
+}
+
+// Returns the diagnostics recorded by a strict parser from everything parsed so far, including hosts routed to by more than one service
+func (p *ServiceParser) Diagnostics() []Diagnostic {
+	if p.diagnostics == nil {
+		return nil
+	}
+
+	p.diagnostics.mutex.Lock()
+	defer p.diagnostics.mutex.Unlock()
+
+	list := make([]Diagnostic, len(p.diagnostics.list))
+	copy(list, p.diagnostics.list)
+
+	keys := make([]string, 0, len(p.diagnostics.urls))
+	for key := range p.diagnostics.urls {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	// Only the service the conflict policy routes a host and path to is reachable, unless the policy merges them
+	for _, key := range keys {
+		routed := p.diagnostics.urls[key]
+
+		claims := make([]Claim, 0, len(routed))
+		for _, url := range routed {
+			claims = append(claims, Claim{Def: url.def, FromKV: url.source.fromKV()})
+		}
+
+		winner, conflict := ResolveConflict(p.options.ConflictPolicy, key, "", claims)
+		if conflict == nil || conflict.Merged {
+			continue
+		}
+
+		var winnerSource routeSource
+		for _, url := range routed {
+			if url.def == winner {
+				winnerSource = url.source
+				break
+			}
+		}
+
+		for _, other := range routed {
+			if other.def.Name() == winner.Name() {
+				continue
+			}
+
+			list = append(list, Diagnostic{
+				Source:  other.source.name,
+				Line:    other.source.line,
+				Message: fmt.Sprintf("URL is routed to %s by %s instead", winner.Upstream, winnerSource),
+				Value:   other.srvUrl,
+			})
+		}
+	}
+
+	list = append(list, p.siteTLSDiagnostics(keys)...)
+
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Source != list[j].Source {
+			return list[i].Source < list[j].Source
+		}
+		return list[i].Line < list[j].Line
+	})
+
+	return list
+}
+
+// Returns a diagnostic for each URL routing a path or a host under a wildcard domain with a tls option differing from the
+// site's, only the service routing the whole site sets its TLS
+func (p *ServiceParser) siteTLSDiagnostics(keys []string) []Diagnostic {
+	type site struct {
+		roots  []Claim
+		others []routedUrl
+	}
+
+	sites := make(map[string]*site)
+	var addresses []string
+	for _, key := range keys {
+		for _, url := range p.diagnostics.urls[key] {
+			host, path := splitUrl(url.srvUrl)
+			address, root := SiteAddress(host), path == ""
+			if wildcardDomain, ok := p.wildcardDomain(host); ok {
+				address, root = wildcardDomain, root && host == wildcardDomain
+			}
+
+			if sites[address] == nil {
+				sites[address] = &site{}
+				addresses = append(addresses, address)
+			}
+			if root {
+				sites[address].roots = append(sites[address].roots, Claim{Def: url.def, FromKV: url.source.fromKV()})
+			} else if url.def.TLS != nil {
+				sites[address].others = append(sites[address].others, url)
+			}
+		}
+	}
+
+	var list []Diagnostic
+	for _, address := range addresses {
+		var siteTLS *TLSOptions
+		if roots := sites[address].roots; len(roots) > 0 {
+			winner, _ := ResolveConflict(p.options.ConflictPolicy, address, "", roots)
+			siteTLS = winner.TLS
+		}
+
+		for _, url := range sites[address].others {
+			if siteTLS != nil && *siteTLS == *url.def.TLS {
+				continue
+			}
+
+			message := fmt.Sprintf("Ignoring tls option, the TLS of %s is set by the service routing the whole site", address)
+			list = append(list, Diagnostic{
+				Source:  url.source.name,
+				Line:    url.source.line,
+				Message: message,
+				Value:   "tls=" + url.def.Options["tls"],
+			})
+		}
+	}
+
+	return list
+}
+
+// Record a diagnostic if the parser is strict
+func (p *ServiceParser) report(source routeSource, message string, value string) {
+	if p.diagnostics == nil {
+		return
+	}
+
+	p.diagnostics.mutex.Lock()
+	defer p.diagnostics.mutex.Unlock()
+
+	p.diagnostics.list = append(p.diagnostics.list, Diagnostic{
+		Source:  source.name,
+		Line:    source.line,
+		Message: message,
+		Value:   value,
+	})
+}
+
+// Check a URL routed to the service if the parser is strict
+func (p *ServiceParser) checkUrl(source routeSource, def *ServiceDef, srvUrl string, host string, path string) {
+	if p.diagnostics == nil {
+		return
+	}
+
+	// A wildcard only matches a single label without a port, other hosts under the domain get a site of their own
+	if _, ok := p.wildcardDomain(host); !ok {
+		hostname := host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			hostname = h
+		}
+
+		for _, wildcardDomain := range p.options.WildcardDomains {
+			if strings.HasPrefix(wildcardDomain, "*.") && strings.HasSuffix(hostname, wildcardDomain[1:]) {
+				p.report(source, fmt.Sprintf("URL is not matched by the wildcard domain %s", wildcardDomain), srvUrl)
+				break
+			}
+		}
+	}
+
+	p.diagnostics.mutex.Lock()
+	defer p.diagnostics.mutex.Unlock()
+
+	// Keyed like the sites of the generated config, hosts differing only by case or the default HTTPS port are the same site
+	key := SiteAddress(host) + path
+	p.diagnostics.urls[key] = append(p.diagnostics.urls[key], routedUrl{
+		source: source,
+		def:    def,
+		srvUrl: srvUrl,
+	})
+}
+
+// Returns an error if the host isn't a valid hostname or IP address, optionally with a port
+func validateHost(host string) error {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("invalid port %q", port)
+		}
+		host = h
+	}
+
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+
+	if len(host) > 253 {
+		return fmt.Errorf("longer than 253 characters")
+	}
+
+	for i, label := range strings.Split(host, ".") {
+		if label == "*" && i == 0 {
+			continue
+		}
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("labels must be 1 to 63 characters")
+		}
+		if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return fmt.Errorf("labels can't start or end with a hyphen")
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Errorf("invalid character %q", c)
+			}
+		}
+	}
+
+	return nil
+}
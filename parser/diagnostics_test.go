@@ -0,0 +1,110 @@
+package parser
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/fortix/caddy-consul-ingress/config"
+
+	consul "github.com/hashicorp/consul/api"
+	"go.uber.org/zap"
+)
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		name            string
+		services        map[string][]string
+		kv              string
+		conflictPolicy  string
+		wildcardDomains []string
+		want            []string
+	}{
+		{
+			name:     "no problems",
+			services: map[string][]string{"web": {"urlprefix-example.com", "urlprefix-example.com/api"}},
+			want:     nil,
+		},
+		{
+			name: "duplicate URL",
+			services: map[string][]string{
+				"api": {"urlprefix-example.com"},
+				"web": {"urlprefix-example.com"},
+			},
+			want: []string{"web: URL is routed to api.service.consul by api instead: example.com"},
+		},
+		{
+			name: "duplicate site address",
+			services: map[string][]string{
+				"api": {"urlprefix-example.com"},
+				"web": {"urlprefix-Example.com:443"},
+			},
+			want: []string{"web: URL is routed to api.service.consul by api instead: Example.com:443"},
+		},
+		{
+			name:     "same service twice",
+			services: map[string][]string{"web": {"urlprefix-example.com", "urlprefix-Example.com:443"}},
+			want:     nil,
+		},
+		{
+			name:           "duplicate KV route with the kv policy",
+			services:       map[string][]string{"web": {"urlprefix-example.com"}},
+			kv:             "example.com http://10.0.0.1:80",
+			conflictPolicy: config.ConflictPolicyKV,
+			want:           []string{"web: URL is routed to http://10.0.0.1:80 by caddy-routes/a:1 instead: example.com"},
+		},
+		{
+			name: "duplicate URL merged",
+			services: map[string][]string{
+				"api": {"urlprefix-example.com"},
+				"web": {"urlprefix-example.com"},
+			},
+			conflictPolicy: config.ConflictPolicyMerge,
+			want:           nil,
+		},
+		{
+			name:            "host under a wildcard domain",
+			services:        map[string][]string{"web": {"urlprefix-a.wild.com"}},
+			wildcardDomains: []string{"*.wild.com"},
+			want:            nil,
+		},
+		{
+			name:            "host not matched by a wildcard domain",
+			services:        map[string][]string{"web": {"urlprefix-a.b.wild.com", "urlprefix-a.wild.com:8080"}},
+			wildcardDomains: []string{"*.wild.com"},
+			want: []string{
+				"web: URL is not matched by the wildcard domain *.wild.com: a.b.wild.com",
+				"web: URL is not matched by the wildcard domain *.wild.com: a.wild.com:8080",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conflictPolicy := test.conflictPolicy
+			if conflictPolicy == "" {
+				conflictPolicy = config.ConflictPolicyFirst
+			}
+			options := &config.Options{
+				UrlPrefix:       "urlprefix-",
+				KVPath:          "caddy-routes",
+				ConflictPolicy:  conflictPolicy,
+				WildcardDomains: test.wildcardDomains,
+			}
+
+			p := NewStrictParser(zap.NewNop(), options)
+			p.ParseServices(test.services, nil)
+			if test.kv != "" {
+				p.ParseKV(&consul.KVPairs{{Key: "caddy-routes/a", Value: []byte(test.kv)}})
+			}
+
+			var got []string
+			for _, diagnostic := range p.Diagnostics() {
+				got = append(got, diagnostic.String())
+			}
+			slices.Sort(got)
+			if !slices.Equal(got, test.want) {
+				t.Errorf("Diagnostics() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
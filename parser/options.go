@@ -0,0 +1,260 @@
+package parser
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// Certificates are issued by Caddy's internal CA
+const TLSModeInternal = "internal"
+
+// Certificates are obtained from ACME with the DNS challenge of a DNS provider module
+const TLSModeDNS = "dns"
+
+// The site is served over plain HTTP
+const TLSModeOff = "off"
+
+// The certificate and key are read from a key in the Consul KV store
+const TLSModeCert = "cert"
+
+// How the certificate of the site serving a route is obtained, set by the tls option
+type TLSOptions struct {
+	Mode string `json:"mode"`
+
+	// Name of the DNS provider module for the dns mode
+	Provider string `json:"provider,omitempty"`
+
+	// KV key holding the PEM certificate chain and key for the cert mode
+	CertKey string `json:"cert_key,omitempty"`
+}
+
+// Returns the TLS options from the value of a tls option, nil if not set
+func parseTLSOptions(value string) *TLSOptions {
+	if value == "" {
+		return nil
+	}
+
+	mode, arg, _ := strings.Cut(value, ":")
+	tls := &TLSOptions{Mode: mode}
+	switch mode {
+	case TLSModeDNS:
+		tls.Provider = arg
+	case TLSModeCert:
+		tls.CertKey = arg
+	}
+	return tls
+}
+
+// Map of the key=value options given on a tag or KV route, unknown options are kept for use by templates
+type OptionMap map[string]string
+
+// Returns the option as a boolean, false if not set or invalid
+func (m OptionMap) Bool(key string) bool {
+	value, _ := strconv.ParseBool(m[key])
+	return value
+}
+
+// Returns a copy of the option map with the other options applied over it
+func (m OptionMap) with(other OptionMap) OptionMap {
+	merged := make(OptionMap, len(m)+len(other))
+	for key, value := range m {
+		merged[key] = value
+	}
+	for key, value := range other {
+		merged[key] = value
+	}
+	return merged
+}
+
+// Returns the options as space separated key=value pairs sorted by key, equal maps give the same string
+func (m OptionMap) String() string {
+	pairs := make([]string, 0, len(m))
+	for key, value := range m {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// Typed values of the options understood by the parser along with the raw option map
+type ServiceOptions struct {
+	UseHttps      bool        `json:"use_https"`
+	SkipTlsVerify bool        `json:"skip_tls_verify"`
+	StripPrefix   string      `json:"strip_prefix,omitempty"`
+	Rewrite       string      `json:"rewrite,omitempty"`
+	Priority      int         `json:"priority,omitempty"`
+	Failover      []string    `json:"failover,omitempty"`
+	TLS           *TLSOptions `json:"tls,omitempty"`
+	Options       OptionMap   `json:"options,omitempty"`
+}
+
+// Validators for the options understood by the parser, each returns the normalised value
+var knownOptions = map[string]func(string) (string, error){
+	"proto":         parseProtoOption,
+	"tlsskipverify": parseBoolOption,
+	"strip":         parsePathOption,
+	"rewrite":       parsePathOption,
+	"priority":      parseIntOption,
+	"dc":            parseNameOption,
+	"failover":      parseNameListOption,
+	"tls":           parseTLSOption,
+}
+
+// Parse the key=value segments of a tag or KV route into an option map
+func (p *ServiceParser) parseOptions(source routeSource, segments []string) OptionMap {
+	options := OptionMap{}
+
+	for _, segment := range segments {
+		key, value, found := strings.Cut(segment, "=")
+		if !found || key == "" {
+			p.log.Warn("Ignoring option, expected key=value", zap.Stringer("source", source), zap.String("option", segment))
+			p.report(source, "Ignoring option, expected key=value", segment)
+			continue
+		}
+
+		if validate, ok := knownOptions[key]; ok {
+			normalised, err := validate(value)
+			if err != nil {
+				p.log.Warn("Ignoring invalid option", zap.Stringer("source", source), zap.String("option", segment), zap.Error(err))
+				p.report(source, fmt.Sprintf("Ignoring invalid option, %v", err), segment)
+				continue
+			}
+			value = normalised
+		} else {
+			p.log.Warn("Unknown option, only available to templates", zap.Stringer("source", source), zap.String("option", segment))
+			p.report(source, "Unknown option, only available to templates", segment)
+		}
+
+		options[key] = value
+	}
+
+	return options
+}
+
+// Merge the options into the service options, replacing any already set, and update the typed values
+func (o *ServiceOptions) merge(options OptionMap) {
+	if o.Options == nil {
+		o.Options = OptionMap{}
+	}
+
+	for key, value := range options {
+		o.Options[key] = value
+	}
+
+	o.UseHttps = o.Options["proto"] == "https"
+	o.SkipTlsVerify = o.Options.Bool("tlsskipverify")
+	o.StripPrefix = o.Options["strip"]
+	o.Rewrite = o.Options["rewrite"]
+	o.Priority, _ = strconv.Atoi(o.Options["priority"])
+
+	o.Failover = nil
+	if failover := o.Options["failover"]; failover != "" {
+		o.Failover = strings.Split(failover, ",")
+	}
+
+	o.TLS = parseTLSOptions(o.Options["tls"])
+}
+
+// Returns a copy of the service options which doesn't share the option map
+func (o ServiceOptions) clone() ServiceOptions {
+	c := o
+	c.Options = make(OptionMap, len(o.Options))
+	for key, value := range o.Options {
+		c.Options[key] = value
+	}
+	return c
+}
+
+func parseProtoOption(value string) (string, error) {
+	value = strings.ToLower(value)
+	if value != "http" && value != "https" {
+		return "", fmt.Errorf("proto must be http or https")
+	}
+	return value, nil
+}
+
+func parseBoolOption(value string) (string, error) {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return "", fmt.Errorf("expected true or false")
+	}
+	return strconv.FormatBool(b), nil
+}
+
+func parseIntOption(value string) (string, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return "", fmt.Errorf("expected a whole number")
+	}
+	return strconv.Itoa(i), nil
+}
+
+// Names of datacenters are lowercase DNS labels
+func parseNameOption(value string) (string, error) {
+	value = strings.ToLower(value)
+	if value == "" || len(value) > 63 {
+		return "", fmt.Errorf("name must be 1 to 63 characters")
+	}
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return "", fmt.Errorf("invalid character %q in name", c)
+		}
+	}
+	return value, nil
+}
+
+func parseNameListOption(value string) (string, error) {
+	names := strings.Split(value, ",")
+	for i, name := range names {
+		normalised, err := parseNameOption(name)
+		if err != nil {
+			return "", err
+		}
+		names[i] = normalised
+	}
+	return strings.Join(names, ","), nil
+}
+
+// TLS is internal, off, dns:<provider> with a DNS provider module built into Caddy, or cert:<kv-key>
+func parseTLSOption(value string) (string, error) {
+	mode, arg, _ := strings.Cut(value, ":")
+	mode = strings.ToLower(mode)
+	switch mode {
+	case TLSModeInternal, TLSModeOff:
+		if arg != "" {
+			return "", fmt.Errorf("tls=%s doesn't take a value", mode)
+		}
+		return mode, nil
+
+	case TLSModeDNS:
+		provider := strings.ToLower(arg)
+		if provider == "" {
+			return "", fmt.Errorf("tls=dns needs a DNS provider, e.g. dns:cloudflare")
+		}
+		if _, err := caddy.GetModule("dns.providers." + provider); err != nil {
+			return "", fmt.Errorf("DNS provider %q isn't built into Caddy", provider)
+		}
+		return mode + ":" + provider, nil
+
+	case TLSModeCert:
+		certKey := strings.Trim(arg, "/")
+		if certKey == "" {
+			return "", fmt.Errorf("tls=cert needs a KV key, e.g. cert:certs/example.com")
+		}
+		return mode + ":" + certKey, nil
+	}
+
+	return "", fmt.Errorf("tls must be internal, off, dns:<provider> or cert:<kv-key>")
+}
+
+func parsePathOption(value string) (string, error) {
+	if !strings.HasPrefix(value, "/") {
+		return "", fmt.Errorf("path must start with /")
+	}
+	return strings.TrimRight(value, "/"), nil
+}
@@ -0,0 +1,55 @@
+package parser
+
+import "testing"
+
+func TestParseTLSOption(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+		err   bool
+	}{
+		{"internal", "internal", false},
+		{"Internal", "internal", false},
+		{"off", "off", false},
+		{"internal:ca", "", true},
+		{"off:80", "", true},
+		{"cert:certs/example.com", "cert:certs/example.com", false},
+		{"cert:/certs/example.com/", "cert:certs/example.com", false},
+		{"cert:", "", true},
+		{"dns:", "", true},
+		{"dns:unknown", "", true},
+		{"acme", "", true},
+		{"", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := parseTLSOption(test.value)
+		if (err != nil) != test.err {
+			t.Errorf("parseTLSOption(%q) error = %v, want error %v", test.value, err, test.err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseTLSOption(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParseTLSOptions(t *testing.T) {
+	tests := []struct {
+		value string
+		want  *TLSOptions
+	}{
+		{"", nil},
+		{"internal", &TLSOptions{Mode: TLSModeInternal}},
+		{"off", &TLSOptions{Mode: TLSModeOff}},
+		{"dns:cloudflare", &TLSOptions{Mode: TLSModeDNS, Provider: "cloudflare"}},
+		{"cert:certs/example.com", &TLSOptions{Mode: TLSModeCert, CertKey: "certs/example.com"}},
+	}
+
+	for _, test := range tests {
+		got := parseTLSOptions(test.value)
+		if (got == nil) != (test.want == nil) || got != nil && *got != *test.want {
+			t.Errorf("parseTLSOptions(%q) = %+v, want %+v", test.value, got, test.want)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package parser
 
 import (
+	"fmt"
+	"net"
 	"sort"
 	"strings"
 
@@ -12,38 +14,122 @@ import (
 
 // Struct to hold service definition along with parsed tags
 type ServiceDef struct {
-	To            string
-	Upstream      string
-	ServiceName   string
-	UseHttps      bool
-	SkipTlsVerify bool
-	SrvUrls       []string
+	To          string   `json:"to"`
+	Upstream    string   `json:"upstream"`
+	ServiceName string   `json:"service_name,omitempty"`
+	Path        string   `json:"path,omitempty"`
+	SrvUrls     []string `json:"urls"`
+	Scope
+	ServiceOptions
+
+	// Services combined into one pool of upstreams by the merge conflict policy when To is dynamic multi
+	Sources []*ServiceDef `json:"sources,omitempty"`
+}
+
+// Returns the Consul service routed to, the name is empty if the upstream is a URL
+func (def *ServiceDef) Service() ServiceRef {
+	return ServiceRef{Name: def.ServiceName, Scope: def.Scope}
+}
+
+// Returns a copy of the service definition without any URLs
+func (def *ServiceDef) cloneWithoutUrls() *ServiceDef {
+	return &ServiceDef{
+		To:             def.To,
+		Upstream:       def.Upstream,
+		ServiceName:    def.ServiceName,
+		Path:           def.Path,
+		SrvUrls:        []string{},
+		Scope:          def.Scope,
+		ServiceOptions: def.ServiceOptions.clone(),
+		Sources:        def.Sources,
+	}
 }
 
 type ServiceGroup struct {
-	To            string
-	Upstream      string
-	ServiceName   string
-	UseHttps      bool
-	SkipTlsVerify bool
-	Services      []*ServiceDef
+	To          string        `json:"to,omitempty"`
+	Upstream    string        `json:"upstream,omitempty"`
+	ServiceName string        `json:"service_name,omitempty"`
+	Services    []*ServiceDef `json:"services"`
+	Scope
+	ServiceOptions
+	Sources []*ServiceDef `json:"sources,omitempty"`
 }
 
 func NewServiceGroup() *ServiceGroup {
 	return &ServiceGroup{
-		To:            "",
-		Upstream:      "",
-		ServiceName:   "",
-		UseHttps:      false,
-		SkipTlsVerify: false,
-		Services:      []*ServiceDef{},
+		To:             "",
+		Upstream:       "",
+		ServiceName:    "",
+		Services:       []*ServiceDef{},
+		Scope:          Scope{},
+		ServiceOptions: ServiceOptions{Options: OptionMap{}},
+		Sources:        nil,
+	}
+}
+
+// Set the default handler of the group to the service, used for requests not matching any of the services
+func (g *ServiceGroup) SetDefault(def *ServiceDef) {
+	g.To = def.To
+	g.Upstream = def.Upstream
+	g.ServiceName = def.ServiceName
+	g.Scope = def.Scope
+	g.ServiceOptions = def.ServiceOptions.clone()
+	g.Sources = def.Sources
+}
+
+// Returns the Consul service of the default handler, the name is empty if there's no default or the upstream is a URL
+func (g *ServiceGroup) Service() ServiceRef {
+	return ServiceRef{Name: g.ServiceName, Scope: g.Scope}
+}
+
+// Returns the TLS options of the wildcard domain, those of the default handler as the services only route hosts under it
+func (g *ServiceGroup) SiteTLS() *TLSOptions {
+	return g.TLS
+}
+
+// Struct to hold the services routed on a single host
+type HostGroup struct {
+	Host     string        `json:"host"`
+	Services []*ServiceDef `json:"services"`
+}
+
+func NewHostGroup(host string) *HostGroup {
+	return &HostGroup{
+		Host:     host,
+		Services: []*ServiceDef{},
+	}
+}
+
+// Address of the site serving a host, hosts differing only by case or the default HTTPS port are the same site
+func SiteAddress(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ":443")
+}
+
+// Returns true if one of the services in the group handles the whole host rather than a path
+func (g *HostGroup) HasRoot() bool {
+	for _, def := range g.Services {
+		if def.Path == "" {
+			return true
+		}
 	}
+	return false
+}
+
+// Returns the TLS options of the site, those of the service routing the whole host as services routing a path only share it
+func (g *HostGroup) SiteTLS() *TLSOptions {
+	for _, def := range g.Services {
+		if def.Path == "" {
+			return def.TLS
+		}
+	}
+	return nil
 }
 
 // Struct to hold all service groups and services
 type Services struct {
-	ServiceGroups map[string]*ServiceGroup
-	Services      []*ServiceDef
+	ServiceGroups map[string]*ServiceGroup `json:"wildcard_groups"`
+	Services      []*ServiceDef            `json:"services"`
+	Conflicts     []Conflict               `json:"conflicts,omitempty"`
 }
 
 func newServices() *Services {
@@ -53,9 +139,104 @@ func newServices() *Services {
 	}
 }
 
+// Returns the Consul services routed to from any of the given services, sorted by their qualified names
+func ServiceRefs(services ...*Services) []ServiceRef {
+	return serviceRefs(false, services)
+}
+
+// Returns the Consul services routed to from any of the given services along with the same services in their failover datacenters,
+// the services whose instances are needed to generate upstreams, sorted by their qualified names
+func FailoverServiceRefs(services ...*Services) []ServiceRef {
+	return serviceRefs(true, services)
+}
+
+// Returns true if any of the services are routed on the host, ignoring case and the port.
+// Hosts only routed by the default handler of a wildcard domain aren't matched.
+func (s *Services) HasHost(host string) bool {
+	if s == nil {
+		return false
+	}
+
+	host = hostname(host)
+	hasHost := func(defs []*ServiceDef) bool {
+		for _, def := range defs {
+			for _, srvUrl := range def.SrvUrls {
+				if hostname(srvUrl) == host {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	if hasHost(s.Services) {
+		return true
+	}
+	for _, serviceGroup := range s.ServiceGroups {
+		if hasHost(serviceGroup.Services) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the host of a service URL in lower case without the port
+func hostname(host string) string {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	return strings.ToLower(host)
+}
+
+func serviceRefs(withFailover bool, services []*Services) []ServiceRef {
+	refs := make(map[ServiceRef]bool)
+	add := func(ref ServiceRef, failover []string) {
+		if ref.Name == "" {
+			return
+		}
+		if !withFailover {
+			failover = nil
+		}
+		for _, failoverRef := range ref.WithFailover(failover) {
+			refs[failoverRef] = true
+		}
+	}
+
+	for _, s := range services {
+		if s == nil {
+			continue
+		}
+
+		for _, def := range s.Services {
+			add(def.Service(), def.Failover)
+		}
+
+		for _, serviceGroup := range s.ServiceGroups {
+			add(serviceGroup.Service(), serviceGroup.Failover)
+			for _, source := range serviceGroup.Sources {
+				add(source.Service(), source.Failover)
+			}
+			for _, def := range serviceGroup.Services {
+				add(def.Service(), def.Failover)
+			}
+		}
+	}
+
+	sorted := make([]ServiceRef, 0, len(refs))
+	for ref := range refs {
+		sorted = append(sorted, ref)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].String() < sorted[j].String()
+	})
+
+	return sorted
+}
+
 type ServiceParser struct {
-	log     *zap.Logger
-	options *config.Options
+	log         *zap.Logger
+	options     *config.Options
+	diagnostics *diagnostics
 }
 
 func NewParser(log *zap.Logger, options *config.Options) *ServiceParser {
@@ -65,107 +246,228 @@ func NewParser(log *zap.Logger, options *config.Options) *ServiceParser {
 	}
 }
 
+// Parse the routes from KV pairs in the default scope
 func (p *ServiceParser) ParseKV(kvPairs *consul.KVPairs) *Services {
+	return p.ParseKVRoutes([]KVRoutes{{Pairs: *kvPairs}})
+}
+
+// Parse the routes from the KV pairs of each scope
+func (p *ServiceParser) ParseKVRoutes(kvRoutes []KVRoutes) *Services {
 	serviceMap := make(map[string]*ServiceDef)
 
-	for _, kv := range *kvPairs {
+	for _, routes := range kvRoutes {
+		p.parseKVPairs(serviceMap, routes.Scope, routes.Pairs)
+	}
+
+	return p.groupServices(serviceMap)
+}
+
+func (p *ServiceParser) parseKVPairs(serviceMap map[string]*ServiceDef, scope Scope, kvPairs consul.KVPairs) {
+	for _, kv := range kvPairs {
 		lines := strings.Split(string(kv.Value), "\n")
-		for _, line := range lines {
+		for i, line := range lines {
+			source := routeSource{name: scope.qualify(kv.Key), line: i + 1}
+
 			segments := strings.Fields(line)
-			if len(segments) >= 2 {
-				to, upstream, serviceName := p.parseService(segments[1])
-				srvUrl := segments[0]
-				useHttps := false
-				skipTlsVerify := false
+			if len(segments) == 0 {
+				continue
+			}
+			if len(segments) < 2 {
+				p.log.Warn("Ignoring route, expected a URL and an upstream", zap.Stringer("source", source), zap.String("route", line))
+				p.report(source, "Ignoring route, expected a URL and an upstream", strings.TrimSpace(line))
+				continue
+			}
 
-				p.log.Info("Found static URL", zap.String("url", srvUrl))
+			to, upstream, service := p.parseService(segments[1], scope)
+			srvUrl := segments[0]
 
-				for _, segment := range segments[1:] {
-					if segment == "proto=https" {
-						useHttps = true
-					}
-					if segment == "tlsskipverify=true" {
-						skipTlsVerify = true
-					}
-				}
+			p.log.Info("Found static URL", zap.String("url", srvUrl))
 
-				def, ok := serviceMap[upstream]
-				if !ok {
-					def = &ServiceDef{
-						To:            to,
-						Upstream:      upstream,
-						ServiceName:   serviceName,
-						SrvUrls:       []string{},
-						UseHttps:      useHttps,
-						SkipTlsVerify: skipTlsVerify,
-					}
-					serviceMap[upstream] = def
-				} else {
-					if useHttps {
-						def.UseHttps = true
-					}
-					if skipTlsVerify {
-						def.SkipTlsVerify = true
-					}
-				}
+			options := p.parseOptions(source, segments[2:])
+			p.addServiceUrl(serviceMap, source, to, upstream, service, srvUrl, options)
+		}
+	}
+}
 
-				def.SrvUrls = append(def.SrvUrls, srvUrl)
+// Parse the services registered in the default scope
+func (p *ServiceParser) ParseServices(services map[string][]string, instances map[string][]*consul.CatalogService) *Services {
+	return p.ParseCatalogs([]Catalog{{Services: services, Instances: instances}})
+}
+
+// Parse the services registered in the catalog of each scope
+func (p *ServiceParser) ParseCatalogs(catalogs []Catalog) *Services {
+	serviceMap := make(map[string]*ServiceDef)
+
+	for _, catalog := range catalogs {
+		p.parseCatalog(serviceMap, catalog)
+	}
+
+	return p.groupServices(serviceMap)
+}
+
+func (p *ServiceParser) parseCatalog(serviceMap map[string]*ServiceDef, catalog Catalog) {
+	// Parse the services in order of name so any diagnostics are consistent
+	names := make([]string, 0, len(catalog.Services))
+	for service := range catalog.Services {
+		names = append(names, service)
+	}
+	sort.Strings(names)
+
+	// Parse the services and their tags
+	for _, name := range names {
+		tags := catalog.Services[name]
+		to, upstream, service := p.parseService(name, catalog.Scope)
+		source := routeSource{name: service.String()}
+
+		// Meta options apply to every URL of the service, options on the tags take precedence
+		metaUrls, metaOptions := p.parseMeta(source, catalog.Instances[name])
+
+		for _, tag := range tags {
+			if strings.HasPrefix(tag, p.options.UrlPrefix) {
+				segments := strings.Fields(tag)
+				srvUrl := strings.TrimPrefix(segments[0], p.options.UrlPrefix)
+
+				p.log.Info("Found service URL", zap.String("url", srvUrl))
+
+				options := metaOptions.with(p.parseOptions(source, segments[1:]))
+				p.addServiceUrl(serviceMap, source, to, upstream, service, srvUrl, options)
+			}
+		}
+
+		for _, metaUrl := range metaUrls {
+			segments := strings.Fields(metaUrl)
+			if len(segments) == 0 {
+				continue
+			}
+
+			p.log.Info("Found service meta URL", zap.String("url", segments[0]))
+
+			options := metaOptions.with(p.parseOptions(source, segments[1:]))
+			p.addServiceUrl(serviceMap, source, to, upstream, service, segments[0], options)
+		}
+	}
+}
+
+// Parse the URLs and options from the meta of the service instances.
+//
+// The urls key holds a comma separated list of URLs which may be followed by options in the same way as tags,
+// all other keys are treated as options. If instances disagree the instance with the lowest ID wins.
+func (p *ServiceParser) parseMeta(source routeSource, instances []*consul.CatalogService) ([]string, OptionMap) {
+	if p.options.MetaPrefix == "" || len(instances) == 0 {
+		return nil, OptionMap{}
+	}
+
+	sorted := make([]*consul.CatalogService, len(instances))
+	copy(sorted, instances)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ServiceID < sorted[j].ServiceID
+	})
+
+	meta := make(map[string]string)
+	for _, instance := range sorted {
+		for key, value := range instance.ServiceMeta {
+			if _, ok := meta[key]; !ok && strings.HasPrefix(key, p.options.MetaPrefix) {
+				meta[key] = value
 			}
 		}
 	}
 
-	// Break the list of services up for wildcard domains
+	var urls []string
+	var segments []string
+	for key, value := range meta {
+		name := strings.TrimPrefix(key, p.options.MetaPrefix)
+		if name == "urls" {
+			urls = strings.Split(value, ",")
+		} else {
+			segments = append(segments, name+"="+value)
+		}
+	}
+
+	// Sort so any warnings are logged in a consistent order
+	sort.Strings(segments)
+
+	return urls, p.parseOptions(source, segments)
+}
+
+// Add a URL to the service definition for the upstream, path and options, creating the definition if needed
+func (p *ServiceParser) addServiceUrl(serviceMap map[string]*ServiceDef, source routeSource, to string, upstream string, service ServiceRef, srvUrl string, options OptionMap) {
+	host, path := splitUrl(srvUrl)
+	if host == "" {
+		p.log.Warn("Ignoring URL without a host", zap.String("url", srvUrl))
+		p.report(source, "Ignoring URL without a host", srvUrl)
+		return
+	}
+
+	// Caddy fails to load the whole config over a host it can't serve
+	if err := validateHost(host); err != nil {
+		p.log.Warn("Ignoring URL with an invalid host", zap.String("url", srvUrl), zap.Error(err))
+		p.report(source, fmt.Sprintf("Ignoring URL with an invalid hostname, %v", err), srvUrl)
+		return
+	}
+
+	// A route to a service in another datacenter
+	if datacenter := options["dc"]; datacenter != "" {
+		if service.Name == "" {
+			p.log.Warn("Ignoring dc option, the upstream isn't a Consul service", zap.Stringer("source", source), zap.String("upstream", upstream))
+			p.report(source, "Ignoring dc option, the upstream isn't a Consul service", "dc="+datacenter)
+		} else {
+			service.Datacenter = datacenter
+			upstream = service.SrvName()
+		}
+	}
+
+	// URLs only share a definition if their options match, so the options of one URL don't apply to the others
+	key := upstream + " " + path + " " + options.String()
+	def, ok := serviceMap[key]
+	if !ok {
+		def = &ServiceDef{
+			To:          to,
+			Upstream:    upstream,
+			ServiceName: service.Name,
+			Path:        path,
+			SrvUrls:     []string{},
+			Scope:       service.Scope,
+		}
+		serviceMap[key] = def
+	}
+
+	def.merge(options)
+	if len(def.Failover) == 0 && def.ServiceName != "" {
+		def.Failover = p.options.FailoverDatacenters
+	}
+	def.SrvUrls = append(def.SrvUrls, host)
+
+	p.checkUrl(source, def, srvUrl, host, path)
+}
+
+// Break the service definitions up into plain services and services grouped under wildcard domains
+func (p *ServiceParser) groupServices(serviceMap map[string]*ServiceDef) *Services {
 	var parsedServices = newServices()
 
+	// Services routing the whole of a wildcard domain, applied once all have been found as more than one may claim it
+	defaults := make(map[string][]Claim)
+
 	for _, defSrc := range serviceMap {
-		def := &ServiceDef{
-			To:            defSrc.To,
-			Upstream:      defSrc.Upstream,
-			ServiceName:   defSrc.ServiceName,
-			SrvUrls:       []string{},
-			UseHttps:      defSrc.UseHttps,
-			SkipTlsVerify: defSrc.SkipTlsVerify,
-		}
+		def := defSrc.cloneWithoutUrls()
 
 		wildcardDefs := make(map[string]*ServiceDef)
 		for _, srvUrl := range defSrc.SrvUrls {
-			var wildcardMatch bool = false
-			var wildcardDomain string
-			if len(p.options.WildcardDomains) > 0 {
-				cmpUrl := strings.Replace(srvUrl, strings.SplitN(srvUrl, ".", 2)[0], "*", 1)
-				for _, wildcardDomain = range p.options.WildcardDomains {
-					if cmpUrl == wildcardDomain {
-						wildcardMatch = true
-						break
-					}
-				}
-			}
+			wildcardDomain, wildcardMatch := p.wildcardDomain(srvUrl)
 
 			if wildcardMatch {
 				// If the service is an exact match for the wildcard then update the wildcard default handler
-				if srvUrl == wildcardDomain {
+				if srvUrl == wildcardDomain && defSrc.Path == "" {
 					p.log.Info("Service URL is for wildcard domain", zap.String("url", srvUrl))
 
 					if _, ok := parsedServices.ServiceGroups[wildcardDomain]; !ok {
 						parsedServices.ServiceGroups[wildcardDomain] = NewServiceGroup()
 					}
 
-					parsedServices.ServiceGroups[wildcardDomain].To = defSrc.To
-					parsedServices.ServiceGroups[wildcardDomain].Upstream = defSrc.Upstream
-					parsedServices.ServiceGroups[wildcardDomain].ServiceName = defSrc.ServiceName
-					parsedServices.ServiceGroups[wildcardDomain].UseHttps = def.UseHttps
-					parsedServices.ServiceGroups[wildcardDomain].SkipTlsVerify = def.SkipTlsVerify
+					defaults[wildcardDomain] = append(defaults[wildcardDomain], Claim{Def: defSrc})
 				} else {
 					// If the wildcard domain is not already in the serviceGroups then add it
 					if _, ok := wildcardDefs[wildcardDomain]; !ok {
-						wildcardDefs[wildcardDomain] = &ServiceDef{
-							To:            defSrc.To,
-							Upstream:      defSrc.Upstream,
-							ServiceName:   defSrc.ServiceName,
-							SrvUrls:       []string{},
-							UseHttps:      def.UseHttps,
-							SkipTlsVerify: def.SkipTlsVerify,
-						}
+						wildcardDefs[wildcardDomain] = defSrc.cloneWithoutUrls()
 					}
 					wildcardDefs[wildcardDomain].SrvUrls = append(wildcardDefs[wildcardDomain].SrvUrls, srvUrl)
 				}
@@ -190,168 +492,88 @@ func (p *ServiceParser) ParseKV(kvPairs *consul.KVPairs) *Services {
 		}
 	}
 
-	// Sort the serviceDefs by service name to keep hash comparison consistent
-	sort.Slice(parsedServices.Services, func(i, j int) bool {
-		return parsedServices.Services[i].Upstream < parsedServices.Services[j].Upstream
-	})
+	for wildcardDomain, claims := range defaults {
+		def, conflict := ResolveConflict(p.options.ConflictPolicy, wildcardDomain, "", claims)
+		if conflict != nil {
+			parsedServices.Conflicts = append(parsedServices.Conflicts, *conflict)
+		}
 
-	// For each service group, sort the serviceDefs by service name to keep hash comparison consistent
-	for _, serviceGroup := range parsedServices.ServiceGroups {
-		sort.Slice(serviceGroup.Services, func(i, j int) bool {
-			return (serviceGroup.Services)[i].Upstream < (serviceGroup.Services)[j].Upstream
-		})
+		parsedServices.ServiceGroups[wildcardDomain].SetDefault(def)
 	}
 
-	return parsedServices
-}
-
-func (p *ServiceParser) ParseServices(services map[string][]string) *Services {
-	var parsedServices = newServices()
-
-	// Parse the services and their tags
-	for service, tags := range services {
-		if len(tags) > 0 {
-			to, upstream, serviceName := p.parseService(service)
-
-			def := &ServiceDef{
-				To:            to,
-				Upstream:      upstream,
-				ServiceName:   serviceName,
-				SrvUrls:       []string{},
-				UseHttps:      false,
-				SkipTlsVerify: false,
-			}
-
-			wildcardDefs := make(map[string]*ServiceDef)
-
-			for _, tag := range tags {
-				if strings.HasPrefix(tag, p.options.UrlPrefix) {
-					segments := strings.Fields(tag)
-					srvUrl := strings.TrimPrefix(segments[0], p.options.UrlPrefix)
-
-					p.log.Info("Found service URL", zap.String("url", srvUrl))
+	SortConflicts(parsedServices.Conflicts)
 
-					var useHttps bool = false
-					var skipTlsVerify bool = false
+	// Sort the serviceDefs to keep hash comparison consistent
+	SortServiceDefs(parsedServices.Services)
 
-					for _, segment := range segments[1:] {
-						if segment == "proto=https" {
-							useHttps = true
-						}
-						if segment == "tlsskipverify=true" {
-							skipTlsVerify = true
-						}
-					}
-
-					// Test if the url is part of a wildcard domain
-					var wildcardMatch bool = false
-					var wildcardDomain string
-					if len(p.options.WildcardDomains) > 0 {
-						cmpUrl := strings.Replace(srvUrl, strings.SplitN(srvUrl, ".", 2)[0], "*", 1)
-						for _, wildcardDomain = range p.options.WildcardDomains {
-							if cmpUrl == wildcardDomain {
-								wildcardMatch = true
-								break
-							}
-						}
-					}
-
-					if wildcardMatch {
-
-						// If the service is an exact match for the wildcard then update the wildcard default handler
-						if srvUrl == wildcardDomain {
-							p.log.Info("Service URL is for wildcard domain", zap.String("url", srvUrl))
-
-							if _, ok := parsedServices.ServiceGroups[wildcardDomain]; !ok {
-								parsedServices.ServiceGroups[wildcardDomain] = NewServiceGroup()
-							}
-
-							parsedServices.ServiceGroups[wildcardDomain].To = to
-							parsedServices.ServiceGroups[wildcardDomain].Upstream = upstream
-							parsedServices.ServiceGroups[wildcardDomain].ServiceName = serviceName
-							parsedServices.ServiceGroups[wildcardDomain].UseHttps = useHttps
-							parsedServices.ServiceGroups[wildcardDomain].SkipTlsVerify = skipTlsVerify
-						} else {
-							// If the wildcard domain is not already in the serviceGroups then add it
-							if _, ok := wildcardDefs[wildcardDomain]; !ok {
-								wildcardDefs[wildcardDomain] = &ServiceDef{
-									To:            to,
-									Upstream:      upstream,
-									ServiceName:   serviceName,
-									SrvUrls:       []string{},
-									UseHttps:      false,
-									SkipTlsVerify: false,
-								}
-							}
-
-							if useHttps {
-								wildcardDefs[wildcardDomain].UseHttps = true
-							}
-							if skipTlsVerify {
-								wildcardDefs[wildcardDomain].SkipTlsVerify = true
-							}
-							wildcardDefs[wildcardDomain].SrvUrls = append(wildcardDefs[wildcardDomain].SrvUrls, srvUrl)
-						}
-					} else {
-						if useHttps {
-							def.UseHttps = true
-						}
-						if skipTlsVerify {
-							def.SkipTlsVerify = true
-						}
-						def.SrvUrls = append(def.SrvUrls, srvUrl)
-					}
-				}
-			}
+	// For each service group, sort the serviceDefs to keep hash comparison consistent
+	for _, serviceGroup := range parsedServices.ServiceGroups {
+		SortServiceDefs(serviceGroup.Services)
+	}
 
-			// If have urls then append to serviceDefs
-			if len(def.SrvUrls) > 0 {
-				parsedServices.Services = append(parsedServices.Services, def)
-			}
+	return parsedServices
+}
 
-			// If have wildcardDefs then append to serviceGroups
-			if len(wildcardDefs) > 0 {
-				for wildcardDomain, wildcardDef := range wildcardDefs {
-					if _, ok := parsedServices.ServiceGroups[wildcardDomain]; !ok {
-						parsedServices.ServiceGroups[wildcardDomain] = NewServiceGroup()
-					}
-					parsedServices.ServiceGroups[wildcardDomain].Services = append(parsedServices.ServiceGroups[wildcardDomain].Services, wildcardDef)
-				}
-			}
-		}
+// Returns the wildcard domain a host is grouped under, the first label of the host is replaced by the wildcard
+func (p *ServiceParser) wildcardDomain(host string) (string, bool) {
+	if len(p.options.WildcardDomains) == 0 {
+		return "", false
 	}
 
-	// Sort the serviceDefs by service name to keep hash comparison consistent
-	sort.Slice(parsedServices.Services, func(i, j int) bool {
-		return parsedServices.Services[i].Upstream < parsedServices.Services[j].Upstream
-	})
-
-	// For each service group, sort the serviceDefs by service name to keep hash comparison consistent
-	for _, serviceGroup := range parsedServices.ServiceGroups {
-		sort.Slice(serviceGroup.Services, func(i, j int) bool {
-			return (serviceGroup.Services)[i].Upstream < (serviceGroup.Services)[j].Upstream
-		})
+	cmpUrl := strings.Replace(host, strings.SplitN(host, ".", 2)[0], "*", 1)
+	for _, wildcardDomain := range p.options.WildcardDomains {
+		if cmpUrl == wildcardDomain {
+			return wildcardDomain, true
+		}
 	}
 
-	return parsedServices
+	return "", false
 }
 
-func (p *ServiceParser) parseService(service string) (string, string, string) {
+// Returns the to and upstream for a service in the scope or a URL, and the Consul service which is empty for a URL
+func (p *ServiceParser) parseService(service string, scope Scope) (string, string, ServiceRef) {
 	var to string
 	var upstream string
-	var serviceName string
+	var ref ServiceRef
 
 	// If service starts with http:// or https:// then use it as is and to will be "to"
 	if strings.HasPrefix(service, "http://") || strings.HasPrefix(service, "https://") {
 		to = "to"
 		upstream = service
-		serviceName = ""
 	} else {
-		// It's a service so append .service.consul to it
+		// It's a service so use its name in Consul DNS
+		ref = ServiceRef{Name: service, Scope: scope}
 		to = "dynamic srv"
-		upstream = service + ".service.consul"
-		serviceName = service
+		upstream = ref.SrvName()
 	}
 
-	return to, upstream, serviceName
+	return to, upstream, ref
+}
+
+// Split a service URL into the host and the path prefix, the path is empty when routing the whole host
+func splitUrl(srvUrl string) (string, string) {
+	host, path, found := strings.Cut(srvUrl, "/")
+	if !found {
+		return host, ""
+	}
+
+	path = "/" + strings.TrimRight(path, "/")
+	if path == "/" {
+		path = ""
+	}
+
+	return host, path
+}
+
+// Sort service definitions so the longest path prefixes come first, services on the same path are sorted by upstream
+func SortServiceDefs(defs []*ServiceDef) {
+	sort.Slice(defs, func(i, j int) bool {
+		if len(defs[i].Path) != len(defs[j].Path) {
+			return len(defs[i].Path) > len(defs[j].Path)
+		}
+		if defs[i].Path != defs[j].Path {
+			return defs[i].Path < defs[j].Path
+		}
+		return defs[i].Upstream < defs[j].Upstream
+	})
 }
@@ -0,0 +1,28 @@
+package parser
+
+import "testing"
+
+func TestSplitUrl(t *testing.T) {
+	tests := []struct {
+		srvUrl string
+		host   string
+		path   string
+	}{
+		{"example.com", "example.com", ""},
+		{"example.com/", "example.com", ""},
+		{"example.com:8080", "example.com:8080", ""},
+		{"example.com/api", "example.com", "/api"},
+		{"example.com/api/", "example.com", "/api"},
+		{"example.com/api/v1//", "example.com", "/api/v1"},
+		{"*.example.com/api", "*.example.com", "/api"},
+		{"/api", "", "/api"},
+		{"", "", ""},
+	}
+
+	for _, test := range tests {
+		host, path := splitUrl(test.srvUrl)
+		if host != test.host || path != test.path {
+			t.Errorf("splitUrl(%q) = %q, %q, want %q, %q", test.srvUrl, host, path, test.host, test.path)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package parser
+
+import (
+	"sort"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// A datacenter along with a namespace and partition of Consul Enterprise, empty for the local datacenter and the defaults of the token
+type Scope struct {
+	Datacenter string `json:"datacenter,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Partition  string `json:"partition,omitempty"`
+}
+
+// Returns the scope as partition/namespace@datacenter, leaving out the parts which are defaults
+func (s Scope) String() string {
+	return s.qualify("")
+}
+
+// Query options reading from the scope
+func (s Scope) QueryOptions() *consul.QueryOptions {
+	return &consul.QueryOptions{
+		Datacenter: s.Datacenter,
+		Namespace:  s.Namespace,
+		Partition:  s.Partition,
+	}
+}
+
+// Returns the scope of a name qualified by it as partition/namespace/name@datacenter, leaving out the parts which are defaults
+func (s Scope) qualify(name string) string {
+	qualified := name
+	if s.Partition != "" {
+		namespace := s.Namespace
+		if namespace == "" {
+			namespace = "default"
+		}
+		qualified = s.Partition + "/" + namespace + "/" + qualified
+	} else if s.Namespace != "" {
+		qualified = s.Namespace + "/" + qualified
+	}
+	qualified = strings.TrimSuffix(qualified, "/")
+
+	if s.Datacenter != "" {
+		qualified += "@" + s.Datacenter
+	}
+	return qualified
+}
+
+// Sort scopes by datacenter, partition then namespace
+func SortScopes(scopes []Scope) {
+	sort.Slice(scopes, func(i, j int) bool {
+		if scopes[i].Datacenter != scopes[j].Datacenter {
+			return scopes[i].Datacenter < scopes[j].Datacenter
+		}
+		if scopes[i].Partition != scopes[j].Partition {
+			return scopes[i].Partition < scopes[j].Partition
+		}
+		return scopes[i].Namespace < scopes[j].Namespace
+	})
+}
+
+// A Consul service in a scope
+type ServiceRef struct {
+	Name string `json:"name"`
+	Scope
+}
+
+// Returns the service name qualified by the scope, e.g. team-a/web, eu/team-a/web or web@dc2, services in the default scope are just the name.
+// Used as the key of the healthy instances of each service.
+func (s ServiceRef) String() string {
+	return s.Scope.qualify(s.Name)
+}
+
+// Returns the Consul DNS name of the service, e.g. web.service.team-a.ns.eu.ap.dc2.dc.consul
+func (s ServiceRef) SrvName() string {
+	name := s.Name + ".service"
+	if s.Namespace != "" {
+		name += "." + s.Namespace + ".ns"
+	}
+	if s.Partition != "" {
+		name += "." + s.Partition + ".ap"
+	}
+	if s.Datacenter != "" {
+		name += "." + s.Datacenter + ".dc"
+	}
+	return name + ".consul"
+}
+
+// Returns the same service in another datacenter
+func (s ServiceRef) InDatacenter(datacenter string) ServiceRef {
+	s.Datacenter = datacenter
+	return s
+}
+
+// Returns the service followed by the same service in each of the failover datacenters, skipping its own datacenter
+func (s ServiceRef) WithFailover(failover []string) []ServiceRef {
+	refs := []ServiceRef{s}
+	for _, datacenter := range failover {
+		if datacenter != s.Datacenter {
+			refs = append(refs, s.InDatacenter(datacenter))
+		}
+	}
+	return refs
+}
+
+// Services registered in the catalog of a scope
+type Catalog struct {
+	Scope
+
+	// Tags of each service
+	Services map[string][]string
+
+	// Instances of each service, used to read the service meta
+	Instances map[string][]*consul.CatalogService
+}
+
+// KV pairs holding routes read from a scope, services are looked up in the same scope
+type KVRoutes struct {
+	Scope
+	Pairs consul.KVPairs
+}
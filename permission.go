@@ -0,0 +1,70 @@
+package caddyconsulingress
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddytls"
+	"go.uber.org/zap"
+)
+
+// ConsulIngressPermission allows on-demand TLS certificates only for the hosts routed by the running ingress.
+//
+// A host is allowed if a service in the catalog or a KV route has a URL on it, including the services under
+// wildcard domains. Other hosts under a wildcard domain, which are only routed by its default handler, are
+// denied so certificates can't be obtained for arbitrary names.
+type ConsulIngressPermission struct {
+	logger *zap.Logger
+}
+
+// CaddyModule returns the Caddy module information.
+func (ConsulIngressPermission) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "tls.permission.consul_ingress",
+		New: func() caddy.Module { return new(ConsulIngressPermission) },
+	}
+}
+
+func (p *ConsulIngressPermission) Provision(ctx caddy.Context) error {
+	p.logger = ctx.Logger()
+	return nil
+}
+
+func (p *ConsulIngressPermission) CertificateAllowed(_ context.Context, name string) error {
+	client := activeClient.Load()
+	if client == nil {
+		return fmt.Errorf("%s: %w, the consul ingress isn't running", name, caddytls.ErrPermissionDenied)
+	}
+
+	if !client.IsRouted(name) {
+		p.logger.Debug("Denied certificate for host which isn't routed", zap.String("host", name))
+		return fmt.Errorf("%s: %w, the host isn't routed", name, caddytls.ErrPermissionDenied)
+	}
+
+	return nil
+}
+
+// UnmarshalCaddyfile sets up the module from Caddyfile tokens. Syntax:
+//
+//	permission consul_ingress
+func (p *ConsulIngressPermission) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next() // consume permission module name
+
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	if d.NextBlock(0) {
+		return d.Errf("unrecognized consul_ingress option '%s'", d.Val())
+	}
+
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*ConsulIngressPermission)(nil)
+	_ caddytls.OnDemandPermission = (*ConsulIngressPermission)(nil)
+	_ caddyfile.Unmarshaler       = (*ConsulIngressPermission)(nil)
+)
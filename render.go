@@ -0,0 +1,134 @@
+package caddyconsulingress
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/fortix/caddy-consul-ingress/parser"
+
+	consul "github.com/hashicorp/consul/api"
+	"gopkg.in/yaml.v3"
+)
+
+// Services and KV routes to render a config from without Consul, read from a JSON or YAML file
+type Fixture struct {
+	Services map[string]FixtureService `yaml:"services"`
+	KV       map[string]string         `yaml:"kv"`
+}
+
+// A service registered in the catalog
+type FixtureService struct {
+	// Name of the service, defaults to its key in the fixture so services with the same name can be in different namespaces
+	Name string `yaml:"name"`
+
+	// Datacenter of the service, along with the namespace and admin partition in Consul Enterprise, defaults to the default scope
+	Datacenter string `yaml:"datacenter"`
+	Namespace  string `yaml:"namespace"`
+	Partition  string `yaml:"partition"`
+
+	// Tags of the service
+	Tags []string `yaml:"tags"`
+
+	// Service meta of the instances
+	Meta map[string]string `yaml:"meta"`
+
+	// Healthy address:port of each instance, used by health upstreams
+	Instances []string `yaml:"instances"`
+}
+
+// Read a fixture from a JSON or YAML file
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// YAML is a superset of JSON so either can be decoded
+	fixture := &Fixture{}
+	if err := yaml.Unmarshal(data, fixture); err != nil {
+		return nil, fmt.Errorf("failed to parse fixture %q: %w", path, err)
+	}
+
+	return fixture, nil
+}
+
+// Generate the config from the fixture in the same way as from the services in Consul
+func (ingressClient *ConsulIngressClient) Render(fixture *Fixture) ([]byte, error) {
+	serviceDefs, kvServiceDefs, instances := ingressClient.parseFixture(ingressClient.parser, fixture)
+	cfg, _, err := ingressClient.generate(serviceDefs, kvServiceDefs, instances)
+	return cfg, err
+}
+
+// Parse the services and KV routes of the fixture with the parser, returns them with the healthy instances of each service.
+// KV routes are read from the default scope.
+func (ingressClient *ConsulIngressClient) parseFixture(p *parser.ServiceParser, fixture *Fixture) (*parser.Services, *parser.Services, map[string][]string) {
+	catalogs := make(map[parser.Scope]parser.Catalog)
+	instances := make(map[string][]string)
+	for key, service := range fixture.Services {
+		ref := parser.ServiceRef{
+			Name:  service.Name,
+			Scope: parser.Scope{Datacenter: service.Datacenter, Namespace: service.Namespace, Partition: service.Partition},
+		}
+		if ref.Name == "" {
+			ref.Name = key
+		}
+
+		catalog, ok := catalogs[ref.Scope]
+		if !ok {
+			catalog = parser.Catalog{
+				Scope:     ref.Scope,
+				Services:  make(map[string][]string),
+				Instances: make(map[string][]*consul.CatalogService),
+			}
+			catalogs[ref.Scope] = catalog
+		}
+
+		catalog.Services[ref.Name] = service.Tags
+
+		if len(service.Meta) > 0 {
+			catalog.Instances[ref.Name] = []*consul.CatalogService{{
+				ServiceID:   ref.Name,
+				ServiceName: ref.Name,
+				ServiceMeta: service.Meta,
+			}}
+		}
+
+		if len(service.Instances) > 0 {
+			instances[ref.String()] = service.Instances
+		}
+	}
+
+	// Parse the scopes in order as the watchers do
+	scopes := make([]parser.Scope, 0, len(catalogs))
+	for scope := range catalogs {
+		scopes = append(scopes, scope)
+	}
+	parser.SortScopes(scopes)
+
+	scopeCatalogs := make([]parser.Catalog, 0, len(scopes))
+	for _, scope := range scopes {
+		scopeCatalogs = append(scopeCatalogs, catalogs[scope])
+	}
+
+	serviceDefs := p.ParseCatalogs(scopeCatalogs)
+
+	var kvServiceDefs *parser.Services
+	if ingressClient.options.KVPath != "" && len(fixture.KV) > 0 {
+		// Order the pairs by key as Consul lists them
+		keys := make([]string, 0, len(fixture.KV))
+		for key := range fixture.KV {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		kvPairs := make(consul.KVPairs, 0, len(keys))
+		for _, key := range keys {
+			kvPairs = append(kvPairs, &consul.KVPair{Key: key, Value: []byte(fixture.KV[key])})
+		}
+
+		kvServiceDefs = p.ParseKV(&kvPairs)
+	}
+
+	return serviceDefs, kvServiceDefs, instances
+}
@@ -0,0 +1,157 @@
+package caddyconsulingress
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"time"
+
+	"github.com/fortix/caddy-consul-ingress/parser"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// State of a blocking query watching Consul
+type WatchStatus struct {
+	Index       uint64    `json:"index"`
+	LastContact time.Time `json:"last_contact"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// Status of the client as reported by the admin API
+type ClientStatus struct {
+	ConfigFormat string                 `json:"config_format"`
+	Config       string                 `json:"config,omitempty"`
+	ConfigHash   string                 `json:"config_hash,omitempty"`
+	Synced       bool                   `json:"synced"`
+	LastSync     *time.Time             `json:"last_sync,omitempty"`
+	LastError    string                 `json:"last_error,omitempty"`
+	FailedConfig string                 `json:"failed_config,omitempty"`
+	Conflicts    []parser.Conflict      `json:"conflicts,omitempty"`
+	Watches      map[string]WatchStatus `json:"watches"`
+	Health       map[string]WatchStatus `json:"health,omitempty"`
+	Election     *ElectionStatus        `json:"election,omitempty"`
+}
+
+// Routes parsed from Consul as reported by the admin API
+type ClientRoutes struct {
+	Catalog *parser.Services `json:"catalog"`
+	KV      *parser.Services `json:"kv"`
+}
+
+// Returns the status of the client
+func (ingressClient *ConsulIngressClient) Status() ClientStatus {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	status := ClientStatus{
+		ConfigFormat: ingressClient.options.ConfigFormat,
+		Config:       string(ingressClient.lastCaddyfile),
+		Synced:       !ingressClient.lastSync.IsZero(),
+		FailedConfig: string(ingressClient.failedCaddyfile),
+		Conflicts:    ingressClient.conflicts,
+		Watches:      make(map[string]WatchStatus, len(ingressClient.watches)),
+	}
+
+	if ingressClient.lastCaddyfile != nil {
+		md5Hash := md5.Sum(ingressClient.lastCaddyfile)
+		status.ConfigHash = hex.EncodeToString(md5Hash[:])
+	}
+	if !ingressClient.lastSync.IsZero() {
+		lastSync := ingressClient.lastSync
+		status.LastSync = &lastSync
+	}
+	if ingressClient.lastError != nil {
+		status.LastError = ingressClient.lastError.Error()
+	}
+
+	for watcher, watchStatus := range ingressClient.watches {
+		status.Watches[watcher] = watchStatus
+	}
+
+	if ingressClient.health != nil {
+		status.Health = ingressClient.health.Status()
+	}
+
+	if ingressClient.options.LeaderKey != "" {
+		election := ingressClient.election
+		status.Election = &election
+	}
+
+	return status
+}
+
+// Returns the services parsed from the catalog and KV store
+func (ingressClient *ConsulIngressClient) Routes() ClientRoutes {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	return ClientRoutes{
+		Catalog: ingressClient.serviceDefs,
+		KV:      ingressClient.kvServiceDefs,
+	}
+}
+
+// Returns true if the host is routed by any of the services parsed from the catalog or KV store
+func (ingressClient *ConsulIngressClient) IsRouted(host string) bool {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	return ingressClient.serviceDefs.HasHost(host) || ingressClient.kvServiceDefs.HasHost(host)
+}
+
+// Record the result of a query made by a watcher
+func (ingressClient *ConsulIngressClient) setWatchStatus(watcher string, meta *consul.QueryMeta, err error) {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	watchStatus := ingressClient.watches[watcher]
+	if err != nil {
+		watchStatus.LastError = err.Error()
+	} else {
+		watchStatus.Index = meta.LastIndex
+		watchStatus.LastContact = time.Now()
+		watchStatus.LastError = ""
+	}
+	ingressClient.watches[watcher] = watchStatus
+}
+
+// Record a config which has been loaded
+func (ingressClient *ConsulIngressClient) setLoaded(caddyfile []byte, hash string) {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	ingressClient.lastCaddyfile = caddyfile
+	ingressClient.failedCaddyfile = nil
+	ingressClient.lastError = nil
+
+	observeLoaded(hash)
+}
+
+// Record a config which failed to generate or load, failedCaddyfile is nil if it couldn't be generated
+func (ingressClient *ConsulIngressClient) setFailure(failedCaddyfile []byte, err error) {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	ingressClient.failedCaddyfile = failedCaddyfile
+	ingressClient.lastError = err
+}
+
+// Record that the running config matches the services in Consul
+func (ingressClient *ConsulIngressClient) setSynced() {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	ingressClient.lastSync = time.Now()
+
+	observeSynced()
+}
+
+// Record the services claiming the same URL in the last generated config
+func (ingressClient *ConsulIngressClient) setConflicts(conflicts []parser.Conflict) {
+	ingressClient.stateMutex.Lock()
+	defer ingressClient.stateMutex.Unlock()
+
+	ingressClient.conflicts = conflicts
+
+	ingressMetrics.conflicts.Set(float64(len(conflicts)))
+}